@@ -3,23 +3,34 @@ package application
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
 
+	"github.com/CatalinPlesu/message-service/handler"
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/migration"
+	"github.com/CatalinPlesu/message-service/repository/message"
 	"github.com/redis/go-redis/v9"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
-	"github.com/CatalinPlesu/message-service/messaging"
 )
 
 type App struct {
-	router http.Handler
-	rdb    *redis.Client
-	db     *bun.DB
-	rabbitMQ *messaging.RabbitMQ
-	config Config
+	router   http.Handler
+	rdb      *redis.Client
+	db       *bun.DB
+	broker   messaging.Broker
+	codec    messaging.Codec
+	hub      *messaging.Hub
+	events   message.EventLog
+	presence message.PresenceStore
+	pgRepo   *message.PostgresRepo
+	messages *message.CachedRepo
+	config   Config
+
+	consumers []messaging.Subscription
 }
 
 func New(config Config) *App {
@@ -27,18 +38,29 @@ func New(config Config) *App {
 		Addr: config.RedisAddress,
 	})
 
-	dsn := fmt.Sprintf("postgresql://%s:%s@%s/%s?sslmode=disable", config.PostgresUser, config.PostgresPassword, config.PostgresAddress, config.PostgresDB)
-	sqlDB := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
-	db := bun.NewDB(sqlDB, pgdialect.New())
+	db := OpenDB(config)
+
+	broker := newBroker(config)
 
+	codec, err := messaging.Codecs.Lookup(config.EventContentType)
+	if err != nil {
+		fmt.Println("falling back to JSON events:", err)
+		codec = messaging.JSONCodec{}
+	}
 
-	rabbitMQ, _ := messaging.NewRabbitMQ(config.RabitMQURL)
+	pgRepo := message.NewPostgresRepo(db)
 
 	app := &App{
-		rdb:    rdb,
-		db:     db,
-		rabbitMQ: rabbitMQ,
-		config: config,
+		rdb:      rdb,
+		db:       db,
+		broker:   broker,
+		codec:    codec,
+		hub:      messaging.NewHub(),
+		events:   &message.RedisRepo{Client: rdb, EventLogLength: config.EventLogLength},
+		presence: &message.PresenceRepo{Client: rdb},
+		pgRepo:   pgRepo,
+		messages: message.NewCachedRepo(pgRepo, rdb, config.CacheTTL),
+		config:   config,
 	}
 
 	app.loadRoutes()
@@ -46,12 +68,48 @@ func New(config Config) *App {
 	return app
 }
 
+// newBroker picks the event backend named by config.Broker.
+func newBroker(config Config) messaging.Broker {
+	topology := messaging.Topology{
+		Exchange:           config.RabitMQExchange,
+		DeclareExchange:    config.RabitMQDeclareExchange,
+		DeadLetterExchange: config.RabitMQDeadLetter,
+	}
+
+	switch config.Broker {
+	case "memory":
+		return messaging.NewMemory(topology)
+	case "none":
+		return messaging.Noop{}
+	case "rabbitmq":
+	default:
+		fmt.Printf("unknown broker %q, using rabbitmq\n", config.Broker)
+	}
+
+	// Connects in the background; until it is up, events stay in the outbox.
+	return messaging.NewRabbitMQ(config.RabitMQURL, topology)
+}
+
+func OpenDB(config Config) *bun.DB {
+	dsn := fmt.Sprintf("postgresql://%s:%s@%s/%s?sslmode=disable", config.PostgresUser, config.PostgresPassword, config.PostgresAddress, config.PostgresDB)
+	sqlDB := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
+	return bun.NewDB(sqlDB, pgdialect.New())
+}
+
 func (a *App) Start(ctx context.Context) error {
+	if a.config.CursorSecret == "" {
+		return errors.New("CURSOR_SECRET is not set; set it to a secret shared by all replicas, or CURSOR_SECRET_RANDOM=true for a single node")
+	}
+
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", a.config.ServerPort),
 		Handler: a.router,
 	}
 
+	// Event streams and long polls only end when the hub closes, and
+	// Shutdown waits for them.
+	server.RegisterOnShutdown(a.hub.Close)
+
 	err := a.rdb.Ping(ctx).Err()
 	if err != nil {
 		return fmt.Errorf("failed to connect to redis: %w", err)
@@ -62,6 +120,19 @@ func (a *App) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
 	}
 
+	migrator, err := migration.New(a.db)
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+	}
+
 	defer func() {
 		if err := a.rdb.Close(); err != nil {
 			fmt.Println("failed to close redis", err)
@@ -69,8 +140,35 @@ func (a *App) Start(ctx context.Context) error {
 		if err := a.db.Close(); err != nil {
 			fmt.Println("failed to close database", err)
 		}
+		if err := a.broker.Close(); err != nil {
+			fmt.Println("failed to close broker", err)
+		}
 	}()
 
+	// Consumers are stopped and drained before the connections above are
+	// closed, whichever way the server exits.
+	ctx, stopConsumers := context.WithCancel(ctx)
+	defer func() {
+		stopConsumers()
+		a.hub.Close()
+		a.drainConsumers(a.config.ShutdownTimeout)
+	}()
+
+	if err := a.runHub(ctx); err != nil {
+		return err
+	}
+
+	if a.config.IngestQueue != "" {
+		ingest := &handler.Ingest{Repo: a.messages}
+		if err := a.consume(ctx, a.config.IngestQueue, ingest.CreateMessage, ingest.Key); err != nil {
+			return err
+		}
+	}
+
+	go a.purge(ctx)
+	go a.relayOutbox(ctx)
+	go a.sweepPresence(ctx)
+
 	fmt.Println("Starting server")
 
 	ch := make(chan error, 1)
@@ -87,11 +185,9 @@ func (a *App) Start(ctx context.Context) error {
 	case err = <-ch:
 		return err
 	case <-ctx.Done():
-		timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		timeout, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
 		defer cancel()
 
 		return server.Shutdown(timeout)
 	}
-
-	return nil
 }
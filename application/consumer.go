@@ -0,0 +1,57 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+)
+
+// consume subscribes handler to queue on the broker, ordering deliveries by
+// key. The subscription runs until ctx is cancelled and is drained before
+// Start returns.
+func (a *App) consume(ctx context.Context, queue string, handler messaging.Handler, key func(messaging.Delivery) []byte) error {
+	subscription, err := a.broker.Subscribe(ctx, queue, handler, a.consumeOptions(key))
+	if err != nil {
+		return fmt.Errorf("failed to consume %s: %w", queue, err)
+	}
+
+	a.consumers = append(a.consumers, subscription)
+	return nil
+}
+
+// runHub feeds the real-time hub from the broker until ctx is cancelled.
+func (a *App) runHub(ctx context.Context) error {
+	subscriptions, err := a.hub.Run(ctx, a.broker, a.consumeOptions(nil))
+	a.consumers = append(a.consumers, subscriptions...)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe hub: %w", err)
+	}
+	return nil
+}
+
+func (a *App) consumeOptions(key func(messaging.Delivery) []byte) messaging.ConsumeOptions {
+	return messaging.ConsumeOptions{
+		Workers:    a.config.ConsumerWorkers,
+		Prefetch:   a.config.ConsumerPrefetch,
+		MaxRetries: a.config.ConsumerMaxRetries,
+		RetryDelay: a.config.ConsumerRetryDelay,
+		Key:        key,
+	}
+}
+
+// drainConsumers waits for the stopped consumers to finish the messages they
+// are handling, giving up after timeout.
+func (a *App) drainConsumers(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	for _, subscription := range a.consumers {
+		select {
+		case <-subscription.Done():
+		case <-deadline:
+			fmt.Println("timed out draining consumers")
+			return
+		}
+	}
+}
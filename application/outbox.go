@@ -0,0 +1,78 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// relayOutbox publishes pending outbox events to the broker until ctx is
+// cancelled. Failed events stay in the outbox and are retried with backoff.
+func (a *App) relayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(a.config.OutboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				sent, err := a.pgRepo.RelayOutbox(ctx, a.config.OutboxBatchSize, a.config.OutboxMaxAttempts, a.publishOutboxEvent)
+				if err != nil {
+					if ctx.Err() == nil {
+						fmt.Println("failed to relay outbox:", err)
+					}
+					break
+				}
+				// A full batch means there may be more waiting; keep going
+				// rather than wait for the next tick.
+				if sent < a.config.OutboxBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// publishOutboxEvent logs the stored JSON event to its channel's event log
+// and publishes it, stamped with its log position, in the configured codec.
+// Decoding upgrades rows written under an older schema version. Only the
+// publish decides whether the event is sent: if the log cannot be written
+// the event goes out without a position, and SSE clients are told to re-read
+// the channel.
+func (a *App) publishOutboxEvent(ctx context.Context, event model.OutboxEvent) error {
+	decoded, err := messaging.JSONCodec{}.Decode(event.Payload)
+	if err != nil {
+		return err
+	}
+
+	// Appending is idempotent per event, so a retried publish keeps the
+	// position the event got the first time.
+	decoded.StreamID, err = a.events.AppendEvent(ctx, decoded)
+	if err != nil {
+		fmt.Println("failed to log outbox event, publishing it unlogged:", err)
+	}
+
+	body, err := a.codec.Encode(decoded)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.config.PublishTimeout)
+	defer cancel()
+
+	// Nobody is bound to the event. Retrying will not change that, and the
+	// event is still in the event log.
+	var unroutable *messaging.UnroutableError
+	err = a.broker.Publish(ctx, event.RoutingKey, a.codec.ContentType(), body)
+	if errors.As(err, &unroutable) {
+		fmt.Println("outbox event was not routed:", err)
+		return nil
+	}
+	return err
+}
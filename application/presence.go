@@ -0,0 +1,57 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+const (
+	presenceSweepInterval = time.Second
+	presenceSweepBatch    = 100
+)
+
+// sweepPresence publishes the end of every typing or online signal that ran
+// out without being cleared, until ctx is cancelled. Each expiry is claimed
+// by one replica, so it is announced once.
+func (a *App) sweepPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				expired, err := a.presence.Expired(ctx, presenceSweepBatch)
+				if err != nil {
+					if ctx.Err() == nil {
+						fmt.Println("failed to sweep presence:", err)
+					}
+					break
+				}
+
+				for _, p := range expired {
+					a.publishPresence(ctx, model.NewPresenceEvent(p, false, p.ExpiresAt))
+				}
+
+				if len(expired) < presenceSweepBatch {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (a *App) publishPresence(ctx context.Context, event model.Event) {
+	ctx, cancel := context.WithTimeout(ctx, a.config.PublishTimeout)
+	defer cancel()
+
+	if err := messaging.PublishEvent(ctx, a.broker, a.codec, event); err != nil {
+		fmt.Println("failed to publish presence:", err)
+	}
+}
@@ -0,0 +1,38 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// purge periodically hard-deletes messages that have been soft deleted, and
+// outbox events that were sent, longer ago than their configured retention.
+// It returns when ctx is cancelled.
+func (a *App) purge(ctx context.Context) {
+	ticker := time.NewTicker(a.config.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+
+			n, err := a.pgRepo.Purge(ctx, now.Add(-a.config.TombstoneRetention))
+			if err != nil {
+				fmt.Println("failed to purge deleted messages:", err)
+			} else if n > 0 {
+				fmt.Printf("Purged %d deleted messages\n", n)
+			}
+
+			n, err = a.pgRepo.PruneOutbox(ctx, now.Add(-a.config.OutboxRetention))
+			if err != nil {
+				fmt.Println("failed to prune outbox:", err)
+			} else if n > 0 {
+				fmt.Printf("Pruned %d sent outbox events\n", n)
+			}
+		}
+	}
+}
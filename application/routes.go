@@ -1,6 +1,7 @@
 package application
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -19,6 +20,19 @@ func (a *App) loadRoutes() {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	router.Get("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.messages.Stats())
+	})
+
+	router.Get("/debug/broker", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"broker": a.config.Broker,
+			"state":  a.broker.State().String(),
+		})
+	})
+
 	router.Route("/messages", a.loadMessageRoutes)
 
 	a.router = router
@@ -26,17 +40,37 @@ func (a *App) loadRoutes() {
 
 func (a *App) loadMessageRoutes(router chi.Router) {
 	messageHandler := &handler.Message{
-		RdRepo: &message.RedisRepo{
-			Client: a.rdb,
-		},
-		PgRepo: message.NewPostgresRepo(a.db),
-		RabbitMQ: a.rabbitMQ,
+		Repo:           a.messages,
+		CursorKey:      []byte(a.config.CursorSecret),
+		EditWindow:     a.config.EditWindow,
+		Idempotency:    &message.RedisRepo{Client: a.rdb},
+		IdempotencyTTL: a.config.IdempotencyTTL,
+		Hub:            a.hub,
+	}
+
+	streamHandler := &handler.Stream{Hub: a.hub, Log: a.events}
+
+	presenceHandler := &handler.Presence{
+		Store:     a.presence,
+		Events:    a.broker,
+		Codec:     a.codec,
+		TypingTTL: a.config.TypingTTL,
+		OnlineTTL: a.config.PresenceTTL,
 	}
 
-	router.Post("/", messageHandler.Create)                                   
-	router.Get("/channel/{id}", messageHandler.ListByChannelID)                                      
-	router.Get("/parent/{id}", messageHandler.ListByParentID)                                      
-	router.Get("/{id}", messageHandler.GetByID)                               
-	router.Put("/{id}", messageHandler.UpdateByID)                            
-	router.Delete("/{id}", messageHandler.DeleteByID)                         
+	router.Post("/", messageHandler.Create)
+	router.Get("/channel/{id}", messageHandler.ListByChannelID)
+	router.Get("/channel/{id}/ws", streamHandler.ChannelWS)
+	router.Get("/channel/{id}/events", streamHandler.ChannelEvents)
+	router.Get("/channel/{id}/presence", presenceHandler.ListByChannelID)
+	router.Post("/channel/{id}/typing", presenceHandler.Typing)
+	router.Delete("/channel/{id}/typing", presenceHandler.StopTyping)
+	router.Post("/channel/{id}/heartbeat", presenceHandler.Heartbeat)
+	router.Delete("/channel/{id}/heartbeat", presenceHandler.Leave)
+	router.Get("/parent/{id}", messageHandler.ListByParentID)
+	router.Get("/{id}", messageHandler.GetByID)
+	router.Put("/{id}", messageHandler.UpdateByID)
+	router.Delete("/{id}", messageHandler.DeleteByID)
+	router.Post("/{id}/restore", messageHandler.RestoreByID)
+	router.Get("/{id}/revisions", messageHandler.ListRevisions)
 }
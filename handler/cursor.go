@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+var (
+	errInvalidCursor  = errors.New("invalid cursor")
+	errCursorMismatch = errors.New("cursor does not belong to this listing")
+)
+
+type listingKind uint8
+
+const (
+	listAll listingKind = iota
+	listChannel
+	listParent
+)
+
+// listing identifies what a cursor pages through, so a token issued for one
+// channel cannot be replayed against another.
+type listing struct {
+	Kind listingKind
+	ID   uuid.UUID
+}
+
+// cursorToken is the client-facing form of a message.Cursor. It is
+// serialised as version | listing | page size | position | direction, then
+// HMAC-SHA256 signed and base64url encoded.
+type cursorToken struct {
+	Listing  listing
+	Size     uint64
+	Position message.Cursor
+}
+
+const (
+	cursorVersion    = 1
+	cursorPayloadLen = 1 + 1 + 16 + 4 + 8 + 16 + 1
+)
+
+func (t cursorToken) encode(key []byte) string {
+	buf := make([]byte, cursorPayloadLen, cursorPayloadLen+sha256.Size)
+	buf[0] = cursorVersion
+	buf[1] = byte(t.Listing.Kind)
+	copy(buf[2:18], t.Listing.ID[:])
+	binary.BigEndian.PutUint32(buf[18:22], uint32(t.Size))
+	binary.BigEndian.PutUint64(buf[22:30], uint64(t.Position.CreatedAt.UnixMicro()))
+	copy(buf[30:46], t.Position.MessageID[:])
+	buf[46] = byte(t.Position.Direction)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+func decodeCursorToken(key []byte, s string) (cursorToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != cursorPayloadLen+sha256.Size {
+		return cursorToken{}, errInvalidCursor
+	}
+
+	payload, sum := buf[:cursorPayloadLen], buf[cursorPayloadLen:]
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return cursorToken{}, errInvalidCursor
+	}
+
+	if payload[0] != cursorVersion {
+		return cursorToken{}, errInvalidCursor
+	}
+
+	direction := message.Direction(payload[46])
+	if direction != message.Forward && direction != message.Backward {
+		return cursorToken{}, errInvalidCursor
+	}
+
+	var t cursorToken
+	t.Listing.Kind = listingKind(payload[1])
+	copy(t.Listing.ID[:], payload[2:18])
+	t.Size = uint64(binary.BigEndian.Uint32(payload[18:22]))
+	t.Position.CreatedAt = time.UnixMicro(int64(binary.BigEndian.Uint64(payload[22:30]))).UTC()
+	copy(t.Position.MessageID[:], payload[30:46])
+	t.Position.Direction = direction
+
+	return t, nil
+}
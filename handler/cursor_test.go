@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+var (
+	testCursorKey = []byte("test cursor key")
+	testChannel   = listing{Kind: listChannel, ID: uuid.MustParse("1b2c3d4e-5f60-4718-92a3-b4c5d6e7f809")}
+	testPosition  = message.Cursor{
+		CreatedAt: time.Date(2024, 11, 2, 9, 30, 0, 123456000, time.UTC),
+		MessageID: uuid.MustParse("9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182"),
+		Direction: message.Backward,
+	}
+)
+
+func testToken(l listing, size uint64) cursorToken {
+	return cursorToken{Listing: l, Size: size, Position: testPosition}
+}
+
+// tampered flips a bit of the token's payload and keeps the signature.
+func tampered(token string) string {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		panic(err)
+	}
+	buf[30] ^= 1
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func TestCursorTokenRoundTrip(t *testing.T) {
+	want := testToken(testChannel, 20)
+
+	got, err := decodeCursorToken(testCursorKey, want.encode(testCursorKey))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	token := testToken(testChannel, 20).encode(testCursorKey)
+
+	otherChannel := testChannel
+	otherChannel.ID = uuid.MustParse("7e6d5c4b-3a29-4180-b7c6-d5e4f3a2b190")
+
+	tests := []struct {
+		name      string
+		query     url.Values
+		want      message.FindAllPage
+		wantErr   error
+		wantError bool
+	}{
+		{
+			name:  "no cursor",
+			query: url.Values{},
+			want:  message.FindAllPage{Size: maxPageSize},
+		},
+		{
+			name:  "cursor",
+			query: url.Values{"cursor": {token}},
+			want:  message.FindAllPage{Size: 20, Cursor: &testPosition},
+		},
+		{
+			name:  "cursor with matching size",
+			query: url.Values{"cursor": {token}, "size": {"20"}},
+			want:  message.FindAllPage{Size: 20, Cursor: &testPosition},
+		},
+		{
+			name:  "after reads forward",
+			query: url.Values{"after": {token}},
+			want: message.FindAllPage{Size: 20, Cursor: &message.Cursor{
+				CreatedAt: testPosition.CreatedAt,
+				MessageID: testPosition.MessageID,
+				Direction: message.Forward,
+			}},
+		},
+		{
+			name:    "tampered",
+			query:   url.Values{"cursor": {tampered(token)}},
+			wantErr: errInvalidCursor,
+		},
+		{
+			name:    "wrong key",
+			query:   url.Values{"cursor": {testToken(testChannel, 20).encode([]byte("other key"))}},
+			wantErr: errInvalidCursor,
+		},
+		{
+			name:    "truncated",
+			query:   url.Values{"cursor": {token[:len(token)-4]}},
+			wantErr: errInvalidCursor,
+		},
+		{
+			name:    "not base64",
+			query:   url.Values{"cursor": {"not a cursor!"}},
+			wantErr: errInvalidCursor,
+		},
+		{
+			name:    "other channel",
+			query:   url.Values{"cursor": {testToken(otherChannel, 20).encode(testCursorKey)}},
+			wantErr: errCursorMismatch,
+		},
+		{
+			name:    "other listing kind",
+			query:   url.Values{"cursor": {testToken(listing{Kind: listAll}, 20).encode(testCursorKey)}},
+			wantErr: errCursorMismatch,
+		},
+		{
+			name:    "size mismatch",
+			query:   url.Values{"cursor": {token}, "size": {"10"}},
+			wantErr: errCursorMismatch,
+		},
+		{
+			name:      "cursor and after",
+			query:     url.Values{"cursor": {token}, "after": {token}},
+			wantError: true,
+		},
+		{
+			name:      "size out of range",
+			query:     url.Values{"size": {"101"}},
+			wantError: true,
+		},
+	}
+
+	h := &Message{CursorKey: testCursorKey}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+tt.query.Encode(), nil)
+
+			got, err := h.parsePage(r, testChannel)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			case tt.wantError:
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			case err != nil:
+				t.Fatalf("got error %v", err)
+			}
+
+			if got.Size != tt.want.Size {
+				t.Errorf("got size %d, want %d", got.Size, tt.want.Size)
+			}
+			if (got.Cursor == nil) != (tt.want.Cursor == nil) || got.Cursor != nil && *got.Cursor != *tt.want.Cursor {
+				t.Errorf("got cursor %+v, want %+v", got.Cursor, tt.want.Cursor)
+			}
+		})
+	}
+}
+
+func TestListByChannelIDRejectsBadCursor(t *testing.T) {
+	token := testToken(testChannel, 20).encode(testCursorKey)
+
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"tampered", url.Values{"cursor": {tampered(token)}}},
+		{"wrong key", url.Values{"cursor": {testToken(testChannel, 20).encode([]byte("other key"))}}},
+		{"other listing", url.Values{"cursor": {testToken(listing{Kind: listAll}, 20).encode(testCursorKey)}}},
+		{"size mismatch", url.Values{"cursor": {token}, "size": {"10"}}},
+		{"tampered after", url.Values{"after": {tampered(token)}}},
+	}
+
+	// The cursor is rejected before the repository is touched.
+	h := &Message{CursorKey: testCursorKey}
+	router := chi.NewRouter()
+	router.Get("/channel/{id}", h.ListByChannelID)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/channel/"+testChannel.ID.String()+"?"+tt.query.Encode(), nil)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
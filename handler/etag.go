@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// currentFinder is implemented by repositories that may answer FindByID
+// from a cache.
+type currentFinder interface {
+	FindCurrent(ctx context.Context, id uuid.UUID) (model.Message, error)
+}
+
+// findCurrent reads the message a conditional write is checked against.
+// A stale cached version would fail If-Match, and the version conflict
+// check in the repository, on every attempt.
+func (h *Message) findCurrent(ctx context.Context, id uuid.UUID) (model.Message, error) {
+	if repo, ok := h.Repo.(currentFinder); ok {
+		return repo.FindCurrent(ctx, id)
+	}
+	return h.Repo.FindByID(ctx, id)
+}
+
+func etag(m model.Message) string {
+	return fmt.Sprintf(`"%d"`, m.Version)
+}
+
+// ifMatch reports whether the request's If-Match preconditions, if any,
+// admit the message's current version. Weak tags never match, as RFC 9110
+// requires strong comparison for If-Match.
+func ifMatch(r *http.Request, m model.Message) bool {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		return true
+	}
+
+	current := etag(m)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == current {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// conflictStatus is the response to a write that lost a race with another
+// writer: 412 if the client stated a precondition, 409 otherwise.
+func conflictStatus(r *http.Request) int {
+	if len(r.Header.Values("If-Match")) > 0 {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusConflict
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyClaim is a key this request holds while it runs.
+type idempotencyClaim struct {
+	key         string
+	fingerprint string
+}
+
+// claimIdempotencyKey handles the Idempotency-Key header. Keys are scoped to
+// the acting user (X-User-ID, or owner when the header is absent), so users
+// can neither collide nor read each other's responses. It returns the claim
+// to save the response under, nil if the request has no key, or false if it
+// has already answered: by replaying the stored response, or with 409 when
+// the key belongs to a different or unfinished request.
+func (h *Message) claimIdempotencyKey(w http.ResponseWriter, r *http.Request, owner uuid.UUID, request any) (*idempotencyClaim, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || h.Idempotency == nil {
+		return nil, true
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := userID(r)
+	if err != nil {
+		http.Error(w, "invalid X-User-ID", http.StatusBadRequest)
+		return nil, false
+	} else if user != nil {
+		owner = *user
+	}
+	scoped := owner.String() + ":" + key
+
+	fingerprint, err := fingerprint(request)
+	if err != nil {
+		fmt.Println("failed to fingerprint request:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	stored, claimed, err := h.Idempotency.ClaimIdempotencyKey(r.Context(), scoped, fingerprint)
+	if err != nil {
+		fmt.Println("failed to claim idempotency key:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	} else if claimed {
+		return &idempotencyClaim{key: scoped, fingerprint: fingerprint}, true
+	}
+
+	if stored.Fingerprint != fingerprint {
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusConflict)
+		return nil, false
+	}
+	if stored.Pending {
+		http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return nil, false
+	}
+
+	if stored.ETag != "" {
+		w.Header().Set("ETag", stored.ETag)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+	return nil, false
+}
+
+// saveIdempotentResponse stores the response for a claimed key. A failure
+// only costs the replay, so it is logged rather than returned.
+func (h *Message) saveIdempotentResponse(ctx context.Context, claim *idempotencyClaim, status int, etag string, body []byte) {
+	if claim == nil {
+		return
+	}
+
+	err := h.Idempotency.SaveIdempotentResponse(ctx, claim.key, message.IdempotentResponse{
+		Fingerprint: claim.fingerprint,
+		Status:      status,
+		ETag:        etag,
+		Body:        body,
+	}, h.IdempotencyTTL)
+	if err != nil {
+		fmt.Println("failed to save idempotent response:", err)
+	}
+}
+
+// releaseIdempotencyKey gives up a claimed key after the request failed, so
+// the client can retry with it.
+func (h *Message) releaseIdempotencyKey(ctx context.Context, claim *idempotencyClaim) {
+	if claim == nil {
+		return
+	}
+
+	if err := h.Idempotency.ReleaseIdempotencyKey(ctx, claim.key); err != nil {
+		fmt.Println("failed to release idempotency key:", err)
+	}
+}
+
+func fingerprint(request any) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/model"
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+var errClientIDReused = errors.New("client_id was already used for a different message")
+
+// Ingest creates messages from commands consumed off the broker, as an
+// asynchronous alternative to POST /messages.
+type Ingest struct {
+	Repo message.Repository
+}
+
+// CreateMessage handles a model.CreateMessageCommand. Invalid commands are
+// rejected without retrying; either way the outcome is sent to the reply-to
+// queue when the command names one.
+func (h *Ingest) CreateMessage(ctx context.Context, d messaging.Delivery) error {
+	var cmd model.CreateMessageCommand
+	if err := json.Unmarshal(d.Body, &cmd); err != nil {
+		return h.reject(ctx, d, uuid.Nil, fmt.Errorf("invalid command: %w", err))
+	}
+
+	if err := validateCommand(cmd); err != nil {
+		return h.reject(ctx, d, cmd.ClientID, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	theMessage := model.Message{
+		MessageID:   cmd.ClientID,
+		ChannelID:   cmd.ChannelID,
+		ParentID:    cmd.ParentID,
+		UserID:      cmd.UserID,
+		MessageText: cmd.MessageText,
+		CreatedAt:   &now,
+		UpdatedAt:   &now,
+		Version:     1,
+	}
+
+	err := h.Repo.Insert(ctx, theMessage)
+	if errors.Is(err, message.ErrAlreadyExists) {
+		return h.duplicate(ctx, d, cmd)
+	} else if errors.Is(err, message.ErrParentNotExist) {
+		return h.reject(ctx, d, cmd.ClientID, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	return h.reply(ctx, d, model.CommandReply{
+		ClientID: cmd.ClientID,
+		Status:   model.CommandCreated,
+		Message:  &theMessage,
+	})
+}
+
+// Key orders commands by channel, so messages sent to one channel are
+// created in the order they were queued. A command that fails and is
+// retried is created after those queued behind it.
+func (h *Ingest) Key(d messaging.Delivery) []byte {
+	var cmd struct {
+		ChannelID uuid.UUID `json:"channel_id"`
+	}
+	json.Unmarshal(d.Body, &cmd)
+	return cmd.ChannelID[:]
+}
+
+// duplicate answers a command whose client ID is already taken. It is a
+// redelivery if the stored message was posted by the same user to the same
+// place; its text is not compared, as it may have been edited since.
+func (h *Ingest) duplicate(ctx context.Context, d messaging.Delivery, cmd model.CreateMessageCommand) error {
+	existing, err := h.Repo.FindByID(ctx, cmd.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to find existing message: %w", err)
+	}
+
+	if existing.ChannelID != cmd.ChannelID || existing.UserID != cmd.UserID || !sameParent(existing.ParentID, cmd.ParentID) {
+		return h.reject(ctx, d, cmd.ClientID, errClientIDReused)
+	}
+
+	existing = existing.Redacted()
+	return h.reply(ctx, d, model.CommandReply{
+		ClientID: cmd.ClientID,
+		Status:   model.CommandDuplicate,
+		Message:  &existing,
+	})
+}
+
+func (h *Ingest) reject(ctx context.Context, d messaging.Delivery, clientID uuid.UUID, cause error) error {
+	err := h.reply(ctx, d, model.CommandReply{
+		ClientID: clientID,
+		Status:   model.CommandRejected,
+		Error:    cause.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", messaging.ErrUnprocessable, cause)
+}
+
+func (h *Ingest) reply(ctx context.Context, d messaging.Delivery, reply model.CommandReply) error {
+	if d.ReplyTo == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reply: %w", err)
+	}
+
+	return d.Reply(ctx, body)
+}
+
+func validateCommand(cmd model.CreateMessageCommand) error {
+	switch {
+	case cmd.ClientID == uuid.Nil:
+		return errors.New("client_id is required")
+	case cmd.ChannelID == uuid.Nil:
+		return errors.New("channel_id is required")
+	case cmd.UserID == uuid.Nil:
+		return errors.New("user_id is required")
+	case strings.TrimSpace(cmd.MessageText) == "":
+		return errors.New("message is required")
+	}
+	return nil
+}
+
+func sameParent(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/model"
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+// maxWait caps how long a listing may be held open, below the idle timeouts
+// of common proxies.
+const maxWait = 60 * time.Second
+
+// parseWait reads the optional wait query parameter, a duration such as 30s.
+// Waiting only makes sense after a position, so it requires after.
+func parseWait(r *http.Request) (time.Duration, error) {
+	waitStr := r.URL.Query().Get("wait")
+	if waitStr == "" {
+		return 0, nil
+	}
+
+	if r.URL.Query().Get("after") == "" {
+		return 0, errors.New("wait requires after")
+	}
+
+	wait, err := time.ParseDuration(waitStr)
+	if err != nil || wait < 0 || wait > maxWait {
+		return 0, fmt.Errorf("invalid wait %q", waitStr)
+	}
+	return wait, nil
+}
+
+// awaitMessages runs find again each time a message is created in the
+// listener's channel, until it returns messages, wait elapses or ctx is done.
+// If the listener is dropped it gives up early with the last result; the
+// client simply polls again.
+func awaitMessages(ctx context.Context, listener *messaging.Listener, wait time.Duration, res message.FindResult, find func(context.Context) (message.FindResult, error)) (message.FindResult, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for len(res.Messages) == 0 {
+		select {
+		case event, ok := <-listener.C:
+			if !ok {
+				return res, nil
+			}
+			if event.Type != model.MessageCreated {
+				continue
+			}
+
+			var err error
+			if res, err = find(ctx); err != nil {
+				return res, err
+			}
+
+		case <-timer.C:
+			return res, nil
+
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+	}
+
+	return res, nil
+}
+
+// tailCursor is the position after the last message of a forward read that
+// reached the end of its listing, where a client waits for what comes next.
+// It is nil when there is a next page, or the read went backward. The
+// position is the last message's creation time, not its commit order; see
+// ListByChannelID.
+func tailCursor(page message.FindAllPage, res message.FindResult) *message.Cursor {
+	if res.Next != nil || page.Cursor != nil && page.Cursor.Direction == message.Backward {
+		return nil
+	}
+
+	tail := message.Cursor{Direction: message.Forward}
+	if n := len(res.Messages); n > 0 {
+		last := res.Messages[n-1]
+		if last.CreatedAt != nil {
+			tail.CreatedAt = last.CreatedAt.UTC().Truncate(time.Microsecond)
+		}
+		tail.MessageID = last.MessageID
+	} else if page.Cursor != nil {
+		tail = *page.Cursor
+	}
+
+	return &tail
+}
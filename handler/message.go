@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,9 +18,18 @@ import (
 )
 
 type Message struct {
-	RdRepo   *message.RedisRepo
-	PgRepo   *message.PostgresRepo
-	RabbitMQ *messaging.RabbitMQ
+	Repo      message.Repository
+	CursorKey []byte
+	// EditWindow limits how long after creation a message may be edited.
+	// Zero means no limit.
+	EditWindow time.Duration
+	// Idempotency stores Create responses by Idempotency-Key for
+	// IdempotencyTTL. When nil the header is ignored.
+	Idempotency    message.IdempotencyStore
+	IdempotencyTTL time.Duration
+	// Hub wakes channel listings waiting for new messages. When nil, wait
+	// is accepted but answered right away.
+	Hub *messaging.Hub
 }
 
 func (h *Message) Create(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +45,14 @@ func (h *Message) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	now := time.Now().UTC()
+	claim, ok := h.claimIdempotencyKey(w, r, body.UserID, body)
+	if !ok {
+		return
+	}
+
+	// Postgres stores microseconds; truncate so the response and any cursor
+	// built from it match what was persisted.
+	now := time.Now().UTC().Truncate(time.Microsecond)
 	theMessage := model.Message{
 		MessageID:   uuid.New(),
 		ChannelID:   body.ChannelID,
@@ -44,69 +61,109 @@ func (h *Message) Create(w http.ResponseWriter, r *http.Request) {
 		MessageText: body.MessageText,
 		CreatedAt:   &now,
 		UpdatedAt:   &now,
+		Version:     1,
 	}
 
-	err := h.PgRepo.Insert(r.Context(), theMessage)
-	if err != nil {
+	err := h.Repo.Insert(r.Context(), theMessage)
+	if errors.Is(err, message.ErrParentNotExist) {
+		h.releaseIdempotencyKey(r.Context(), claim)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		h.releaseIdempotencyKey(r.Context(), claim)
 		fmt.Println("failed to insert message:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	err = h.RabbitMQ.PublishMessage("message", model.MessageMin{
-		ChannelID:   theMessage.ChannelID,
-		ParentID:    theMessage.ParentID,
-		UserID:      theMessage.UserID,
-		MessageText: theMessage.MessageText,
-		CreatedAt:   theMessage.CreatedAt,
-	})
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to publish to RabbitMQ: %v", err), http.StatusInternalServerError)
-		return
-	}
-
 	res, err := json.Marshal(theMessage)
 	if err != nil {
+		h.releaseIdempotencyKey(r.Context(), claim)
 		fmt.Println("failed to marshal message:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	h.saveIdempotentResponse(r.Context(), claim, http.StatusCreated, etag(theMessage), res)
+
+	w.Header().Set("ETag", etag(theMessage))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(res)
 }
 
-func (h *Message) List(w http.ResponseWriter, r *http.Request) {
+const maxPageSize = 100
+
+// parsePage reads the optional size and cursor query parameters. A cursor
+// must carry a valid signature and have been issued for the same listing and
+// page size, otherwise the request is rejected. A cursor passed as after
+// instead always reads forward from its position.
+func (h *Message) parsePage(r *http.Request, l listing) (message.FindAllPage, error) {
+	page := message.FindAllPage{Size: maxPageSize}
+
+	sizeStr := r.URL.Query().Get("size")
+	if sizeStr != "" {
+		size, err := strconv.ParseUint(sizeStr, 10, 64)
+		if err != nil || size == 0 || size > maxPageSize {
+			return message.FindAllPage{}, fmt.Errorf("invalid page size %q", sizeStr)
+		}
+		page.Size = size
+	}
+
 	cursorStr := r.URL.Query().Get("cursor")
+	afterStr := r.URL.Query().Get("after")
+	if cursorStr != "" && afterStr != "" {
+		return message.FindAllPage{}, errors.New("cursor and after are exclusive")
+	}
+	if afterStr != "" {
+		cursorStr = afterStr
+	}
 	if cursorStr == "" {
-		cursorStr = "0"
+		return page, nil
 	}
 
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	token, err := decodeCursorToken(h.CursorKey, cursorStr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return message.FindAllPage{}, err
 	}
 
-	const size = 100
-	res, err := h.PgRepo.FindAll(r.Context(), message.FindAllPage{
-		Offset: cursor,
-		Size:   size,
-	})
-	if err != nil {
-		fmt.Println("failed to find all messages:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if token.Listing != l || sizeStr != "" && token.Size != page.Size {
+		return message.FindAllPage{}, errCursorMismatch
+	}
+
+	page.Size = token.Size
+	page.Cursor = &token.Position
+	if afterStr != "" {
+		page.Cursor.Direction = message.Forward
 	}
 
+	return page, nil
+}
+
+func (h *Message) writePage(w http.ResponseWriter, l listing, page message.FindAllPage, res message.FindResult) {
 	var response struct {
 		Items []model.Message `json:"items"`
-		Next  uint64          `json:"next,omitempty"`
+		Next  string          `json:"next,omitempty"`
+		Prev  string          `json:"prev,omitempty"`
+		// After is set on channel listings read forward to the end: passed
+		// back as after, with wait, it blocks for the next new messages.
+		// Messages committed out of creation order can be skipped.
+		After string `json:"after,omitempty"`
+	}
+	response.Items = make([]model.Message, len(res.Messages))
+	for i, m := range res.Messages {
+		response.Items[i] = m.Redacted()
+	}
+	if res.Next != nil {
+		response.Next = cursorToken{Listing: l, Size: page.Size, Position: *res.Next}.encode(h.CursorKey)
+	}
+	if res.Prev != nil {
+		response.Prev = cursorToken{Listing: l, Size: page.Size, Position: *res.Prev}.encode(h.CursorKey)
+	}
+	if l.Kind == listChannel {
+		if tail := tailCursor(page, res); tail != nil {
+			response.After = cursorToken{Listing: l, Size: page.Size, Position: *tail}.encode(h.CursorKey)
+		}
 	}
-	response.Items = res.Messages
-	response.Next = res.Cursor
 
 	data, err := json.Marshal(response)
 	if err != nil {
@@ -118,6 +175,34 @@ func (h *Message) List(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+func (h *Message) List(w http.ResponseWriter, r *http.Request) {
+	l := listing{Kind: listAll}
+
+	page, err := h.parsePage(r, l)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.Repo.FindAll(r.Context(), page)
+	if err != nil {
+		fmt.Println("failed to find all messages:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.writePage(w, l, page, res)
+}
+
+// ListByChannelID lists a channel oldest first. With after and wait, an
+// empty result is held back until new messages arrive after the cursor or
+// wait elapses, whichever comes first.
+//
+// Positions are ordered by creation time, which is set before a message is
+// committed. Concurrent writes can commit out of that order, so a message
+// committed late may land before a position already handed out and never be
+// returned after it. Clients that cannot miss a message should follow the
+// channel's event stream instead.
 func (h *Message) ListByChannelID(w http.ResponseWriter, r *http.Request) {
 	idParam := chi.URLParam(r, "id")
 
@@ -128,49 +213,48 @@ func (h *Message) ListByChannelID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
+	l := listing{Kind: listChannel, ID: channelID}
 
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	page, err := h.parsePage(r, l)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	res, cursor, err := h.PgRepo.FindByChannelID(r.Context(), channelID, message.FindAllPage{
-		Offset: cursor,
-		Size:   100,
-	})
-
+	wait, err := parseWait(r)
 	if err != nil {
-		if errors.Is(err, message.ErrNotExist) {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		fmt.Println("failed to find messages by channel ID:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	var response struct {
-		Items []model.Message `json:"items"`
-		Next  uint64          `json:"next,omitempty"`
+	// Listen before the first read so a message created in between still
+	// wakes the request.
+	var listener *messaging.Listener
+	if wait > 0 && h.Hub != nil {
+		if listener, err = h.Hub.Listen(channelID); err == nil {
+			defer listener.Close()
+		}
 	}
-	response.Items = res
-	response.Next = cursor
 
-	data, err := json.Marshal(response)
+	find := func(ctx context.Context) (message.FindResult, error) {
+		return h.Repo.FindByChannelID(ctx, channelID, page)
+	}
+
+	res, err := find(r.Context())
+	if err == nil && len(res.Messages) == 0 && listener != nil {
+		res, err = awaitMessages(r.Context(), listener, wait, res, find)
+		if r.Context().Err() != nil {
+			// The client gave up waiting.
+			return
+		}
+	}
 	if err != nil {
-		fmt.Println("failed to marshal messages:", err)
+		fmt.Println("failed to find messages by channel ID:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(data)
+	h.writePage(w, l, page, res)
 }
 
 func (h *Message) ListByParentID(w http.ResponseWriter, r *http.Request) {
@@ -182,49 +266,22 @@ func (h *Message) ListByParentID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
+	l := listing{Kind: listParent, ID: parentID}
 
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	page, err := h.parsePage(r, l)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	res, cursor, err := h.PgRepo.FindByParentID(r.Context(), parentID, message.FindAllPage{
-		Offset: cursor,
-		Size:   100,
-	})
-
+	res, err := h.Repo.FindByParentID(r.Context(), parentID, page)
 	if err != nil {
-		if errors.Is(err, message.ErrNotExist) {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		fmt.Println("failed to find messages by channel ID:", err)
+		fmt.Println("failed to find messages by parent ID:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	var response struct {
-		Items []model.Message `json:"items"`
-		Next  uint64          `json:"next,omitempty"`
-	}
-	response.Items = res
-	response.Next = cursor
-
-	data, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("failed to marshal messages:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(data)
+	h.writePage(w, l, page, res)
 }
 
 func (h *Message) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -236,7 +293,7 @@ func (h *Message) GetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	theMessage, err := h.PgRepo.FindByID(r.Context(), messageID)
+	theMessage, err := h.Repo.FindByID(r.Context(), messageID)
 	if errors.Is(err, message.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -246,7 +303,8 @@ func (h *Message) GetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(theMessage); err != nil {
+	w.Header().Set("ETag", etag(theMessage))
+	if err := json.NewEncoder(w).Encode(theMessage.Redacted()); err != nil {
 		fmt.Println("failed to marshal message:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -271,8 +329,8 @@ func (h *Message) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	theMessage, err := h.PgRepo.FindByID(r.Context(), messageID)
-	if errors.Is(err, message.ErrNotExist) {
+	theMessage, err := h.findCurrent(r.Context(), messageID)
+	if errors.Is(err, message.ErrNotExist) || err == nil && theMessage.DeletedAt != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -281,19 +339,44 @@ func (h *Message) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ifMatch(r, theMessage) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	editedBy, err := userID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	now := time.Now().UTC()
-	if body.MessageText != "" {
-		theMessage.MessageText = *&body.MessageText
+	if h.EditWindow > 0 && theMessage.CreatedAt != nil && now.Sub(*theMessage.CreatedAt) > h.EditWindow {
+		http.Error(w, "edit window has expired", http.StatusForbidden)
+		return
+	}
+
+	if body.MessageText != "" && body.MessageText != theMessage.MessageText {
+		theMessage.MessageText = body.MessageText
+		theMessage.Edited = true
 	}
 	theMessage.UpdatedAt = &now
 
-	err = h.PgRepo.Update(r.Context(), theMessage)
-	if err != nil {
+	err = h.Repo.Update(r.Context(), theMessage, editedBy)
+	if errors.Is(err, message.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, message.ErrVersionConflict) {
+		w.WriteHeader(conflictStatus(r))
+		return
+	} else if err != nil {
 		fmt.Println("failed to update message:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	theMessage.Version++
 
+	w.Header().Set("ETag", etag(theMessage))
 	if err := json.NewEncoder(w).Encode(theMessage); err != nil {
 		fmt.Println("failed to marshal message:", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -301,6 +384,60 @@ func (h *Message) UpdateByID(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Message) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+
+	messageID, err := uuid.Parse(idParam) // Parse as UUID
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Revisions of a deleted message would reveal its text.
+	theMessage, err := h.Repo.FindByID(r.Context(), messageID)
+	if errors.Is(err, message.ErrNotExist) || err == nil && theMessage.DeletedAt != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("failed to find message by id:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := h.Repo.Revisions(r.Context(), messageID)
+	if err != nil {
+		fmt.Println("failed to find revisions:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response struct {
+		Items []model.MessageRevision `json:"items"`
+	}
+	response.Items = revisions
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("failed to marshal revisions:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// userID reads the acting user from the X-User-ID header set by the gateway.
+// The header is optional; a malformed value is an error.
+func userID(r *http.Request) (*uuid.UUID, error) {
+	header := r.Header.Get("X-User-ID")
+	if header == "" {
+		return nil, nil
+	}
+
+	id, err := uuid.Parse(header)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
 func (h *Message) DeleteByID(w http.ResponseWriter, r *http.Request) {
 	idParam := chi.URLParam(r, "id")
 
@@ -310,13 +447,71 @@ func (h *Message) DeleteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.PgRepo.DeleteByID(r.Context(), messageID)
+	deletedBy, err := userID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	theMessage, err := h.findCurrent(r.Context(), messageID)
+	if errors.Is(err, message.ErrNotExist) || err == nil && theMessage.DeletedAt != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("failed to find message by id:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ifMatch(r, theMessage) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	err = h.Repo.DeleteByID(r.Context(), messageID, deletedBy, theMessage.Version)
 	if errors.Is(err, message.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if errors.Is(err, message.ErrVersionConflict) {
+		w.WriteHeader(conflictStatus(r))
+		return
 	} else if err != nil {
 		fmt.Println("failed to delete message by id:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+func (h *Message) RestoreByID(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+
+	messageID, err := uuid.Parse(idParam) // Parse as UUID
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = h.Repo.Restore(r.Context(), messageID)
+	if errors.Is(err, message.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("failed to restore message by id:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	theMessage, err := h.Repo.FindByID(r.Context(), messageID)
+	if err != nil {
+		fmt.Println("failed to find message by id:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag(theMessage))
+	if err := json.NewEncoder(w).Encode(theMessage); err != nil {
+		fmt.Println("failed to marshal message:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/model"
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+// Presence takes typing and heartbeat signals from the user in X-User-ID and
+// reports who is active in a channel. A user starting or stopping is
+// published on the real-time event stream; expiry is published by the
+// application's sweeper.
+type Presence struct {
+	Store  message.PresenceStore
+	Events messaging.Publisher
+	Codec  messaging.Codec
+	// TypingTTL and OnlineTTL are how long a signal lasts; clients repeat
+	// them well within it.
+	TypingTTL time.Duration
+	OnlineTTL time.Duration
+}
+
+func (h *Presence) Typing(w http.ResponseWriter, r *http.Request) {
+	h.signal(w, r, model.PresenceTyping, h.TypingTTL)
+}
+
+func (h *Presence) StopTyping(w http.ResponseWriter, r *http.Request) {
+	h.clear(w, r, model.PresenceTyping)
+}
+
+func (h *Presence) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	h.signal(w, r, model.PresenceOnline, h.OnlineTTL)
+}
+
+func (h *Presence) Leave(w http.ResponseWriter, r *http.Request) {
+	h.clear(w, r, model.PresenceOnline)
+}
+
+func (h *Presence) ListByChannelID(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+
+	channelID, err := uuid.Parse(idParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var response struct {
+		Online []model.Presence `json:"online"`
+		Typing []model.Presence `json:"typing"`
+	}
+
+	response.Online, err = h.Store.Active(r.Context(), model.PresenceOnline, channelID)
+	if err == nil {
+		response.Typing, err = h.Store.Active(r.Context(), model.PresenceTyping, channelID)
+	}
+	if err != nil {
+		fmt.Println("failed to list presence:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("failed to marshal presence:", err)
+	}
+}
+
+func (h *Presence) signal(w http.ResponseWriter, r *http.Request, kind model.PresenceKind, ttl time.Duration) {
+	channelID, user, ok := presenceTarget(w, r)
+	if !ok {
+		return
+	}
+
+	presence, started, err := h.Store.Signal(r.Context(), kind, channelID, user, ttl)
+	if err != nil {
+		fmt.Println("failed to signal presence:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if started {
+		h.publish(r, presence, true)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(presence); err != nil {
+		fmt.Println("failed to marshal presence:", err)
+	}
+}
+
+func (h *Presence) clear(w http.ResponseWriter, r *http.Request, kind model.PresenceKind) {
+	channelID, user, ok := presenceTarget(w, r)
+	if !ok {
+		return
+	}
+
+	cleared, err := h.Store.Clear(r.Context(), kind, channelID, user)
+	if err != nil {
+		fmt.Println("failed to clear presence:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if cleared {
+		h.publish(r, model.Presence{Kind: kind, ChannelID: channelID, UserID: user, ExpiresAt: time.Now().UTC()}, false)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publish announces a transition. Presence is ephemeral, so an event lost
+// to a broker outage is only logged.
+func (h *Presence) publish(r *http.Request, presence model.Presence, active bool) {
+	event := model.NewPresenceEvent(presence, active, time.Now())
+	if err := messaging.PublishEvent(r.Context(), h.Events, h.Codec, event); err != nil {
+		fmt.Println("failed to publish presence:", err)
+	}
+}
+
+// presenceTarget reads the channel and the signalling user, answering the
+// request itself when either is missing or invalid.
+func presenceTarget(w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, bool) {
+	channelID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	user, err := userID(r)
+	if err != nil || user == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return channelID, *user, true
+}
@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+const (
+	// heartbeatPeriod keeps proxies from closing a quiet event stream.
+	heartbeatPeriod = 15 * time.Second
+	// replayBatch is how many logged events are read at a time on reconnect.
+	replayBatch = 100
+	// resetEvent tells the client it may have missed events and should
+	// re-read the channel.
+	resetEvent = "event: reset\ndata: {}\n\n"
+)
+
+// ChannelEvents streams the channel's events as Server-Sent Events: the
+// event type as the SSE event name, the JSON model.Event as data and its
+// stream ID as the SSE id, so IDs increase within a channel. A client
+// reconnecting with Last-Event-ID first gets the events it missed from the
+// channel's event log. If the log no longer reaches back that far, a reset
+// event is sent before everything it still holds, and one is also sent with
+// any event that could not be logged; the client should re-read the
+// channel.
+func (h *Stream) ChannelEvents(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+
+	channelID, err := uuid.Parse(idParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID != "" && !message.ValidStreamID(lastEventID) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Listen before replaying so nothing logged in between is lost; events
+	// that show up in both are dropped by ID below.
+	listener, err := h.Hub.Listen(channelID)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer listener.Close()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// A fresh stream starts from the end of the log, so that events logged
+	// from now on are sent from it like any others.
+	last := lastEventID
+	if last == "" {
+		last, err = h.Log.LastEventID(r.Context(), channelID)
+	} else {
+		last, err = h.catchUp(r.Context(), w, channelID, last)
+	}
+	if err != nil {
+		fmt.Println("failed to replay events:", err)
+		return
+	}
+
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-listener.C:
+			if !ok {
+				// The client reconnects with Last-Event-ID and catches up.
+				return
+			}
+
+			switch {
+			case event.StreamID == "":
+				// Presence events are not logged and go straight out. A
+				// message event that could not be logged leaves a gap a
+				// reconnect cannot replay, so the client is told to re-read
+				// the channel.
+				if event.Presence == nil {
+					if _, err := io.WriteString(w, resetEvent); err != nil {
+						return
+					}
+				}
+				if err := writeSSE(w, event); err != nil {
+					return
+				}
+
+			case message.CompareStreamIDs(event.StreamID, last) > 0:
+				// Events reach the hub in publish order, which may differ
+				// from log order. Sending from the log instead also sends
+				// anything logged before this event that is still on its
+				// way, so IDs stay in order and nothing is skipped.
+				if last, err = h.catchUp(r.Context(), w, channelID, last); err != nil {
+					fmt.Println("failed to replay events:", err)
+					return
+				}
+
+			default:
+				// Events are logged before they are published, so this one
+				// was already sent from the log.
+			}
+
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// catchUp writes the channel's logged events after position after, or a
+// reset event and everything still logged if the log no longer reaches back
+// that far. It returns the position of the last event written.
+func (h *Stream) catchUp(ctx context.Context, w io.Writer, channelID uuid.UUID, after string) (string, error) {
+	last, err := h.replay(ctx, w, channelID, after)
+	if errors.Is(err, message.ErrEventsTrimmed) {
+		if _, err := io.WriteString(w, resetEvent); err != nil {
+			return last, err
+		}
+		last, err = h.replay(ctx, w, channelID, "0")
+	}
+	return last, err
+}
+
+// replay writes the channel's logged events after position after and
+// returns the position of the last one written.
+func (h *Stream) replay(ctx context.Context, w io.Writer, channelID uuid.UUID, after string) (string, error) {
+	for {
+		events, err := h.Log.EventsSince(ctx, channelID, after, replayBatch)
+		if err != nil {
+			return after, err
+		}
+
+		for _, event := range events {
+			if err := writeSSE(w, event); err != nil {
+				return after, err
+			}
+			after = event.StreamID
+		}
+
+		if len(events) < replayBatch {
+			return after, nil
+		}
+	}
+}
+
+func writeSSE(w io.Writer, event model.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if event.StreamID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.StreamID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
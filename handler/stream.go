@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/CatalinPlesu/message-service/messaging"
+	"github.com/CatalinPlesu/message-service/repository/message"
+)
+
+const (
+	// writeWait bounds a single write to the client.
+	writeWait = 10 * time.Second
+	// pongWait is how long the client may stay silent, pongs included.
+	pongWait = 60 * time.Second
+	// pingPeriod must be shorter than pongWait so a healthy client always
+	// has a ping to answer.
+	pingPeriod = pongWait * 9 / 10
+	// maxClientMessage caps what the client may send; the stream is one-way
+	// and anything it sends is discarded.
+	maxClientMessage = 512
+)
+
+// Stream pushes a channel's message events to clients as they happen.
+type Stream struct {
+	Hub      *messaging.Hub
+	Log      message.EventLog
+	Upgrader websocket.Upgrader
+}
+
+// ChannelWS streams the channel's events over a WebSocket as JSON
+// model.Event values. A client that cannot keep up is disconnected with
+// close code 1013 (try again later) and should reconnect and re-read the
+// channel to catch up.
+func (h *Stream) ChannelWS(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+
+	channelID, err := uuid.Parse(idParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	listener, err := h.Hub.Listen(channelID)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer listener.Close()
+
+	// Upgrade writes the error response itself on failure.
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	gone := make(chan struct{})
+	go readPump(conn, gone)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-listener.C:
+			if !ok {
+				closeStream(conn, listener.Err())
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			if err != nil {
+				return
+			}
+
+		case <-gone:
+			return
+		}
+	}
+}
+
+// readPump reads until the client goes away, which is how pongs and close
+// frames are processed. It closes gone when it stops.
+func readPump(conn *websocket.Conn, gone chan<- struct{}) {
+	defer close(gone)
+
+	conn.SetReadLimit(maxClientMessage)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func closeStream(conn *websocket.Conn, reason error) {
+	code := websocket.CloseNormalClosure
+	if errors.Is(reason, messaging.ErrListenerTooSlow) {
+		code = websocket.CloseTryAgainLater
+	} else if errors.Is(reason, messaging.ErrHubClosed) {
+		code = websocket.CloseGoingAway
+	}
+
+	text := ""
+	if reason != nil {
+		text = reason.Error()
+	}
+
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		fmt.Println("failed to close websocket:", err)
+	}
+}
@@ -0,0 +1,44 @@
+package messaging
+
+import (
+	"context"
+)
+
+// Publisher sends an encoded message under a routing key. contentType tells
+// consumers how to decode body.
+type Publisher interface {
+	Publish(ctx context.Context, routingKey, contentType string, body []byte) error
+}
+
+// Subscriber delivers messages to a handler until ctx is cancelled.
+//
+// Subscribe shares a durable queue with every other subscriber to it, so
+// each message is handled once. SubscribeTopic gets its own copy of every
+// message whose routing key matches bindingKey, through a queue that lives
+// only as long as the subscription; messages published while it is
+// disconnected are missed, and failed deliveries are dropped.
+type Subscriber interface {
+	Subscribe(ctx context.Context, queue string, handler Handler, options ConsumeOptions) (Subscription, error)
+	SubscribeTopic(ctx context.Context, bindingKey string, handler Handler, options ConsumeOptions) (Subscription, error)
+}
+
+// Subscription is closed by cancelling the context it was created with.
+type Subscription interface {
+	// Done is closed once the subscription has stopped and the messages it
+	// was handling are finished.
+	Done() <-chan struct{}
+}
+
+// Broker is a Publisher and Subscriber sharing one backend.
+type Broker interface {
+	Publisher
+	Subscriber
+	State() State
+	Close() error
+}
+
+var (
+	_ Broker = (*RabbitMQ)(nil)
+	_ Broker = (*Memory)(nil)
+	_ Broker = Noop{}
+)
@@ -0,0 +1,148 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+var (
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+	ErrUnsupportedSchema      = errors.New("unsupported event schema version")
+)
+
+// Codec encodes events for the wire in one content type. Decode accepts
+// every schema version up to model.EventSchemaVersion and returns the event
+// upgraded to the current one.
+type Codec interface {
+	ContentType() string
+	Encode(event model.Event) ([]byte, error)
+	Decode(data []byte) (model.Event, error)
+}
+
+// Registry maps content types to codecs. Publishers look up the codec they
+// were configured with; consumers look up the one named by a delivery's
+// content type.
+type Registry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// Codecs holds the codecs the service understands.
+var Codecs = NewRegistry(JSONCodec{}, ProtobufCodec{})
+
+func NewRegistry(codecs ...Codec) *Registry {
+	r := &Registry{codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+// Register adds c under its content type and any aliases.
+func (r *Registry) Register(c Codec, aliases ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.codecs[c.ContentType()] = c
+	for _, alias := range aliases {
+		r.codecs[alias] = c
+	}
+}
+
+// Lookup finds the codec for a content type, ignoring parameters such as
+// charset. An empty content type means JSON, which is what events were
+// published as before content types were set.
+func (r *Registry) Lookup(contentType string) (Codec, error) {
+	mediaType := ContentTypeJSON
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedContentType, contentType)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedContentType, contentType)
+	}
+	return c, nil
+}
+
+// Decode reads the event carried by a delivery. Failures wrap
+// ErrUnprocessable, as redelivering the same bytes cannot fix them.
+func (r *Registry) Decode(d Delivery) (model.Event, error) {
+	c, err := r.Lookup(d.ContentType)
+	if err != nil {
+		return model.Event{}, fmt.Errorf("%w: %w", ErrUnprocessable, err)
+	}
+
+	event, err := c.Decode(d.Body)
+	if err != nil {
+		return model.Event{}, fmt.Errorf("%w: %w", ErrUnprocessable, err)
+	}
+	return event, nil
+}
+
+// PublishEvent encodes event with c and publishes it under its routing key.
+// Message events go through the outbox instead; this is for events that are
+// not worth keeping if the broker is down.
+func PublishEvent(ctx context.Context, p Publisher, c Codec, event model.Event) error {
+	body, err := c.Encode(event)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event.RoutingKey(), c.ContentType(), body)
+}
+
+// upgrade brings a decoded event to model.EventSchemaVersion.
+func upgrade(event model.Event) (model.Event, error) {
+	if event.SchemaVersion > model.EventSchemaVersion {
+		return model.Event{}, fmt.Errorf("%w: %d", ErrUnsupportedSchema, event.SchemaVersion)
+	}
+
+	if event.SchemaVersion == 0 {
+		// The payload only gained these fields in version 1.
+		event.Payload.MessageID = event.MessageID
+		event.Payload.Deleted = event.Type == model.MessageDeleted
+	}
+
+	event.SchemaVersion = model.EventSchemaVersion
+	return event, nil
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Encode(event model.Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+	return data, nil
+}
+
+func (JSONCodec) Decode(data []byte) (model.Event, error) {
+	var event model.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return model.Event{}, fmt.Errorf("failed to decode event: %w", err)
+	}
+	return upgrade(event)
+}
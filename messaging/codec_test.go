@@ -0,0 +1,151 @@
+package messaging
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// schemaFixtures holds events exactly as earlier builds put them on the
+// wire. Add a fixture for every schema version and content type that ships,
+// and never edit one afterwards.
+//
+//go:embed schema/*.json schema/*.pb
+var schemaFixtures embed.FS
+
+var fixtureEvent = func() model.Event {
+	parentID := uuid.MustParse("4a1f6c1e-2d6b-4c38-9a57-0d1f0e2b7c11")
+	createdAt := time.Date(2024, 11, 2, 9, 30, 0, 123456000, time.UTC)
+	updatedAt := time.Date(2024, 11, 2, 9, 45, 12, 0, time.UTC)
+
+	return model.Event{
+		SchemaVersion: 1,
+		EventID:       uuid.MustParse("0f8b6f5e-7c1a-4b7e-8d2c-5a9e3b1c4d60"),
+		Type:          model.MessageUpdated,
+		MessageID:     uuid.MustParse("9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182"),
+		ChannelID:     uuid.MustParse("1b2c3d4e-5f60-4718-92a3-b4c5d6e7f809"),
+		OccurredAt:    updatedAt,
+		Payload: model.EventPayload{
+			MessageID:   uuid.MustParse("9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182"),
+			ChannelID:   uuid.MustParse("1b2c3d4e-5f60-4718-92a3-b4c5d6e7f809"),
+			ParentID:    &parentID,
+			UserID:      uuid.MustParse("7e6d5c4b-3a29-4180-b7c6-d5e4f3a2b190"),
+			MessageText: "hello, world",
+			CreatedAt:   &createdAt,
+			UpdatedAt:   &updatedAt,
+			Edited:      true,
+			Version:     2,
+		},
+	}
+}()
+
+var compatibilityFixtures = []struct {
+	file        string
+	contentType string
+	want        func() model.Event
+}{
+	{"schema/event.v0.json", ContentTypeJSON, func() model.Event {
+		// Version 0 payloads lack everything after created_at except what
+		// upgrade derives from the envelope.
+		e := fixtureEvent
+		e.Payload.UpdatedAt = nil
+		e.Payload.Edited = false
+		e.Payload.Version = 0
+		return e
+	}},
+	{"schema/event.v1.json", ContentTypeJSON, func() model.Event { return fixtureEvent }},
+	{"schema/event.v1.pb", ContentTypeProtobuf, func() model.Event { return fixtureEvent }},
+}
+
+// TestCompatibilityFixtures checks that the registered codecs still decode
+// every fixture to the event it was written from, guarding against wire
+// format changes that would break consumers on older builds or events still
+// sitting in queues and outboxes.
+func TestCompatibilityFixtures(t *testing.T) {
+	for _, f := range compatibilityFixtures {
+		t.Run(f.file, func(t *testing.T) {
+			data, err := schemaFixtures.ReadFile(f.file)
+			if err != nil {
+				t.Fatalf("failed to read fixture: %v", err)
+			}
+
+			got, err := Codecs.Decode(Delivery{Body: data, ContentType: f.contentType})
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			assertSameEvent(t, got, f.want())
+		})
+	}
+}
+
+// TestCodecRoundTrip checks that each registered codec reads back what it
+// writes for the current schema.
+func TestCodecRoundTrip(t *testing.T) {
+	expiresAt := time.Date(2024, 11, 2, 9, 45, 17, 0, time.UTC)
+
+	logged := fixtureEvent
+	logged.StreamID = "1730540712000-3"
+
+	presence := model.Event{
+		SchemaVersion: model.EventSchemaVersion,
+		EventID:       uuid.MustParse("5d4c3b2a-1908-4f7e-a6d5-c4b3a2918070"),
+		Type:          model.UserTyping,
+		ChannelID:     fixtureEvent.ChannelID,
+		OccurredAt:    fixtureEvent.OccurredAt,
+		Presence: &model.Presence{
+			Kind:      model.PresenceTyping,
+			ChannelID: fixtureEvent.ChannelID,
+			UserID:    fixtureEvent.Payload.UserID,
+			ExpiresAt: expiresAt,
+		},
+	}
+
+	Codecs.mu.RLock()
+	defer Codecs.mu.RUnlock()
+
+	for contentType, c := range Codecs.codecs {
+		for name, event := range map[string]model.Event{
+			"message":  fixtureEvent,
+			"logged":   logged,
+			"presence": presence,
+		} {
+			t.Run(contentType+"/"+name, func(t *testing.T) {
+				data, err := c.Encode(event)
+				if err != nil {
+					t.Fatalf("failed to encode: %v", err)
+				}
+
+				got, err := c.Decode(data)
+				if err != nil {
+					t.Fatalf("failed to decode: %v", err)
+				}
+
+				assertSameEvent(t, got, event)
+			})
+		}
+	}
+}
+
+func assertSameEvent(t *testing.T, got, want model.Event) {
+	t.Helper()
+
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("decoded %s, want %s", gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,516 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// ErrUnprocessable marks a handler error that retrying cannot fix. The
+// delivery is dead-lettered straight away.
+var ErrUnprocessable = errors.New("unprocessable message")
+
+// Delivery is one consumed message.
+type Delivery struct {
+	Body          []byte
+	ContentType   string
+	RoutingKey    string
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+
+	reply func(ctx context.Context, body []byte) error
+}
+
+// Reply sends body to the queue named by ReplyTo, tagged with the
+// delivery's correlation ID. It does nothing when ReplyTo is empty.
+func (d Delivery) Reply(ctx context.Context, body []byte) error {
+	if d.ReplyTo == "" || d.reply == nil {
+		return nil
+	}
+	return d.reply(ctx, body)
+}
+
+// Handler processes one consumed message. Returning an error schedules a
+// retry, unless it wraps ErrUnprocessable.
+type Handler func(ctx context.Context, delivery Delivery) error
+
+// ConsumeOptions controls how a consumer handles and acknowledges deliveries.
+type ConsumeOptions struct {
+	// Workers is the number of messages handled at once. Messages with the
+	// same Key always go to the same worker, so they are handled in the
+	// order they arrived, except that a failed message is retried after the
+	// ones that came in behind it.
+	Workers int
+	// Prefetch is the number of unacknowledged deliveries the broker sends
+	// ahead of the workers.
+	Prefetch int
+	// MaxRetries is how many times a failed delivery is redelivered before
+	// it is dead-lettered. Zero dead-letters on the first failure.
+	MaxRetries int
+	// RetryDelay is how long a failed delivery waits in "<queue>.retry"
+	// before it goes back to the queue. Later deliveries with the same key
+	// are not held back meanwhile, so a retried delivery loses its place.
+	RetryDelay time.Duration
+	// Key picks the ordering key of a delivery. Deliveries with the same
+	// key go to the same worker and are handled in the order they arrived,
+	// retries aside. The default is ChannelKey, which orders events by
+	// channel.
+	Key func(Delivery) []byte
+}
+
+const (
+	defaultWorkers    = 4
+	defaultPrefetch   = 10
+	defaultRetryDelay = 5 * time.Second
+
+	retryCountHeader = "x-retry-count"
+	// routingKeyHeader keeps the routing key a message was first published
+	// with; a retried copy comes back from "<queue>.retry" keyed by queue.
+	routingKeyHeader = "x-original-routing-key"
+)
+
+func (o ConsumeOptions) withDefaults() ConsumeOptions {
+	if o.Workers <= 0 {
+		o.Workers = defaultWorkers
+	}
+	if o.Prefetch <= 0 {
+		o.Prefetch = max(defaultPrefetch, o.Workers)
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultRetryDelay
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.Key == nil {
+		o.Key = ChannelKey
+	}
+	return o
+}
+
+// Consumer is a queue consumer registered with ConsumeMessages or
+// SubscribeTopic. It is started again after every reconnect until its
+// context is cancelled.
+type Consumer struct {
+	queue string
+	// bindingKey is set for topic subscriptions, whose queue is exclusive
+	// to the consumer and bound to the exchange with this key.
+	bindingKey string
+	handler    Handler
+	options    ConsumeOptions
+	ctx        context.Context
+
+	sessions sync.WaitGroup
+	done     chan struct{}
+}
+
+// Done is closed once the consumer's context is cancelled and the messages
+// it was handling have been acknowledged.
+func (c *Consumer) Done() <-chan struct{} {
+	return c.done
+}
+
+// ChannelKey orders event deliveries by channel: the last word of an event
+// routing key, <type>.<channel_id>, whatever the event type. A routing key
+// without a dot is used whole.
+func ChannelKey(d Delivery) []byte {
+	key := d.RoutingKey
+	if i := strings.LastIndexByte(key, '.'); i >= 0 {
+		key = key[i+1:]
+	}
+	return []byte(key)
+}
+
+type delivery struct {
+	amqp091.Delivery
+	delivery Delivery
+}
+
+// Consume messages from the RabbitMQ queue until ctx is cancelled.
+// Deliveries are acknowledged once handler returns nil. When it returns an
+// error the message is retried after options.RetryDelay, up to
+// options.MaxRetries times, and then dead-lettered; errors wrapping
+// ErrUnprocessable are dead-lettered at once.
+//
+// On cancellation the consumer stops taking deliveries and hands back every
+// one it has not started on, including those waiting for a worker, and
+// closes Done when the ones being handled are finished. If the broker is
+// down right now, the consumer starts once the connection comes up.
+func (r *RabbitMQ) ConsumeMessages(ctx context.Context, queueName string, handler Handler, options ConsumeOptions) (*Consumer, error) {
+	return r.register(&Consumer{
+		queue:   queueName,
+		handler: handler,
+		options: options.withDefaults(),
+		ctx:     ctx,
+		done:    make(chan struct{}),
+	})
+}
+
+// Subscribe is ConsumeMessages behind the Subscriber interface.
+func (r *RabbitMQ) Subscribe(ctx context.Context, queue string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	consumer, err := r.ConsumeMessages(ctx, queue, handler, options)
+	if err != nil {
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// SubscribeTopic consumes from an exclusive, auto-deleted queue bound to the
+// exchange with bindingKey. The queue keeps its name across reconnects.
+func (r *RabbitMQ) SubscribeTopic(ctx context.Context, bindingKey string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	return r.register(&Consumer{
+		queue:      fmt.Sprintf("%s.listener.%s", r.topology.Exchange, uuid.NewString()),
+		bindingKey: bindingKey,
+		handler:    handler,
+		options:    options.withDefaults(),
+		ctx:        ctx,
+		done:       make(chan struct{}),
+	})
+}
+
+func (r *RabbitMQ) register(c *Consumer) (*Consumer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.State() == Closed {
+		return nil, ErrClosed
+	}
+
+	if r.conn != nil {
+		if err := c.start(r.conn, r.topology); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("Queued consumer for %s until RabbitMQ is connected", c.queue)
+	}
+
+	r.consumers = append(r.consumers, c)
+	go r.stopConsumer(c)
+
+	return c, nil
+}
+
+// stopConsumer waits for c's context, forgets c so it is not started again,
+// then waits for its running session to drain.
+func (r *RabbitMQ) stopConsumer(c *Consumer) {
+	<-c.ctx.Done()
+
+	r.mu.Lock()
+	r.consumers = slices.DeleteFunc(r.consumers, func(other *Consumer) bool {
+		return other == c
+	})
+	r.mu.Unlock()
+
+	c.sessions.Wait()
+	close(c.done)
+
+	log.Printf("Stopped consuming messages from queue %s", c.queue)
+}
+
+// start runs c on a channel of its own, so its prefetch limit and retry
+// publishes don't interfere with Publish. It is called with r.mu held.
+func (c *Consumer) start(conn *amqp091.Connection, t Topology) error {
+	if c.ctx.Err() != nil {
+		return nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a consumer channel: %w", err)
+	}
+
+	// A channel-level error leaves the connection open; close it so the
+	// supervisor reconnects and the consumer is started again.
+	closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+	go func() {
+		if err := <-closed; err != nil {
+			log.Printf("Consumer channel for %s closed: %v", c.queue, err)
+			conn.Close()
+		}
+	}()
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	if err := ch.Qos(c.options.Prefetch, 0, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to set prefetch: %w", err)
+	}
+
+	if c.bindingKey != "" {
+		err = declareTopicQueue(ch, t, c.queue, c.bindingKey)
+	} else {
+		err = declareQueue(ch, t, c.queue)
+	}
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	tag := uuid.NewString()
+
+	msgs, err := ch.Consume(
+		c.queue,
+		tag,
+		false, // Auto-acknowledge messages
+		false, // Exclusive
+		false, // No-local
+		false, // No-wait
+		nil,   // Arguments
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to register a consumer: %w", err)
+	}
+
+	c.sessions.Add(1)
+	go c.run(ch, tag, msgs)
+
+	log.Printf("Started consuming messages from queue %s with %d workers", c.queue, c.options.Workers)
+	return nil
+}
+
+// run dispatches deliveries to the workers until the channel closes or the
+// consumer's context is cancelled.
+func (c *Consumer) run(ch *amqp091.Channel, tag string, msgs <-chan amqp091.Delivery) {
+	defer c.sessions.Done()
+	defer ch.Close()
+
+	// Each worker's buffer holds the whole prefetch window, so dispatching
+	// never blocks behind a slow worker.
+	var wg sync.WaitGroup
+	workers := make([]chan delivery, c.options.Workers)
+	for i := range workers {
+		workers[i] = make(chan delivery, c.options.Prefetch)
+
+		wg.Add(1)
+		go func(in <-chan delivery) {
+			defer wg.Done()
+			for d := range in {
+				// Once stopping, buffered deliveries go back to the queue
+				// rather than hold up shutdown.
+				if c.ctx.Err() != nil {
+					if err := d.Nack(false, true); err != nil {
+						log.Printf("Failed to requeue message from %s: %v", c.queue, err)
+					}
+					continue
+				}
+				c.handle(ch, d)
+			}
+		}(workers[i])
+	}
+
+	stopping := c.ctx.Done()
+	draining := false
+
+loop:
+	for {
+		select {
+		case <-stopping:
+			// Stop the broker sending more. The deliveries already on their
+			// way arrive before msgs closes and are handed back.
+			if err := ch.Cancel(tag, false); err != nil {
+				log.Printf("Failed to cancel consumer for %s: %v", c.queue, err)
+			}
+			stopping = nil
+			draining = true
+
+		case d, ok := <-msgs:
+			if !ok {
+				break loop
+			}
+			if draining {
+				if err := d.Nack(false, true); err != nil {
+					log.Printf("Failed to requeue message from %s: %v", c.queue, err)
+				}
+				continue
+			}
+			c.dispatch(ch, workers, d)
+		}
+	}
+
+	for _, w := range workers {
+		close(w)
+	}
+	wg.Wait()
+}
+
+// dispatch hands d to the worker that owns its ordering key.
+func (c *Consumer) dispatch(ch *amqp091.Channel, workers []chan delivery, d amqp091.Delivery) {
+	routingKey := d.RoutingKey
+	if original, ok := d.Headers[routingKeyHeader].(string); ok {
+		routingKey = original
+	}
+
+	message := Delivery{
+		Body:          d.Body,
+		ContentType:   d.ContentType,
+		RoutingKey:    routingKey,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		reply: func(ctx context.Context, body []byte) error {
+			return reply(ctx, ch, d, body)
+		},
+	}
+
+	workers[workerFor(c.options.Key(message), len(workers))] <- delivery{Delivery: d, delivery: message}
+}
+
+// workerFor maps an ordering key to one of n workers.
+func workerFor(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+func (c *Consumer) handle(ch *amqp091.Channel, d delivery) {
+	// In-flight messages are finished during shutdown, so the handler does
+	// not see the consumer's cancellation.
+	err := c.handler(context.WithoutCancel(c.ctx), d.delivery)
+	if err == nil {
+		if err := d.Ack(false); err != nil {
+			log.Printf("Failed to ack message from %s: %v", c.queue, err)
+		}
+		return
+	}
+
+	if c.bindingKey != "" {
+		// Topic subscriptions have no retry or dead-letter queues.
+		log.Printf("Dropping message from %s: %v", c.queue, err)
+		reject(d.Delivery)
+		return
+	}
+
+	if errors.Is(err, ErrUnprocessable) {
+		log.Printf("Dead-lettering message from %s: %v", c.queue, err)
+		reject(d.Delivery)
+		return
+	}
+
+	retries := retryCount(d.Headers)
+	if retries >= c.options.MaxRetries {
+		log.Printf("Dead-lettering message from %s after %d retries: %v", c.queue, retries, err)
+		reject(d.Delivery)
+		return
+	}
+
+	log.Printf("Retrying message from %s in %s: %v", c.queue, c.options.RetryDelay, err)
+
+	if err := c.retry(ch, d.Delivery, retries+1); err != nil {
+		// Put it back rather than lose it; it is redelivered straight away.
+		log.Printf("Failed to schedule retry for message from %s: %v", c.queue, err)
+		if err := d.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message from %s: %v", c.queue, err)
+		}
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Printf("Failed to ack message from %s: %v", c.queue, err)
+	}
+}
+
+// retry parks a copy of d in the retry queue with the delay as its TTL and
+// waits for the broker to confirm it before the original is acked. The copy
+// keeps everything a handler can see, the routing key included.
+func (c *Consumer) retry(ch *amqp091.Channel, d amqp091.Delivery, retries int) error {
+	headers := amqp091.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(retries)
+	if _, ok := headers[routingKeyHeader]; !ok {
+		headers[routingKeyHeader] = d.RoutingKey
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		context.Background(),
+		"",
+		c.queue+".retry",
+		false, // Mandatory
+		false, // Immediate
+		amqp091.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp091.Persistent,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Timestamp:     d.Timestamp,
+			Expiration:    strconv.FormatInt(c.options.RetryDelay.Milliseconds(), 10),
+			Body:          d.Body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish retry: %w", err)
+	}
+
+	if !confirm.Wait() {
+		return ErrNacked
+	}
+	return nil
+}
+
+// reply publishes body to d's reply-to queue through the default exchange
+// and waits for the broker to confirm it.
+func reply(ctx context.Context, ch *amqp091.Channel, d amqp091.Delivery, body []byte) error {
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		"",
+		d.ReplyTo,
+		false, // Mandatory
+		false, // Immediate
+		amqp091.Publishing{
+			ContentType:   ContentTypeJSON,
+			CorrelationId: d.CorrelationId,
+			MessageId:     uuid.NewString(),
+			Body:          body,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish reply: %w", err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for reply confirm: %w", err)
+	}
+	if !acked {
+		return ErrNacked
+	}
+	return nil
+}
+
+func retryCount(headers amqp091.Table) int {
+	switch n := headers[retryCountHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	default:
+		return 0
+	}
+}
+
+// reject hands d to the queue's dead-letter exchange.
+func reject(d amqp091.Delivery) {
+	if err := d.Nack(false, false); err != nil {
+		log.Printf("Failed to reject message: %v", err)
+	}
+}
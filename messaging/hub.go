@@ -0,0 +1,158 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+var (
+	ErrListenerTooSlow = errors.New("listener fell too far behind")
+	ErrHubClosed       = errors.New("hub is closed")
+)
+
+const listenerBuffer = 64
+
+// eventBindingKeys match every message and presence event routing key.
+var eventBindingKeys = []string{"message.#", "presence.#"}
+
+// Hub fans the service's message and presence events out to in-process
+// listeners by channel. It is fed by topic subscriptions, so every replica
+// sees every event whichever replica made the change.
+type Hub struct {
+	mu        sync.Mutex
+	listeners map[uuid.UUID]map[*Listener]struct{}
+	closed    bool
+}
+
+// Listener receives the events of one channel on C. If it falls more than
+// its buffer behind, or the hub closes, C is closed and Err says why.
+type Listener struct {
+	C <-chan model.Event
+
+	c         chan model.Event
+	hub       *Hub
+	channelID uuid.UUID
+	err       error
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		listeners: make(map[uuid.UUID]map[*Listener]struct{}),
+	}
+}
+
+// Run feeds the hub from every message and presence event on the broker
+// until ctx is cancelled. There is a subscription per binding key. Events
+// are ordered by channel, so listeners get each channel's events in the
+// order they were published.
+func (h *Hub) Run(ctx context.Context, subscriber Subscriber, options ConsumeOptions) ([]Subscription, error) {
+	options.Key = ChannelKey
+
+	var subscriptions []Subscription
+	for _, key := range eventBindingKeys {
+		subscription, err := subscriber.SubscribeTopic(ctx, key, h.handle, options)
+		if err != nil {
+			return subscriptions, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (h *Hub) handle(ctx context.Context, d Delivery) error {
+	event, err := Codecs.Decode(d)
+	if err != nil {
+		return err
+	}
+
+	h.Broadcast(event)
+	return nil
+}
+
+// Broadcast hands event to the listeners of its channel without blocking.
+// A listener whose buffer is full is dropped rather than allowed to hold up
+// the others.
+func (h *Hub) Broadcast(event model.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for l := range h.listeners[event.ChannelID] {
+		select {
+		case l.c <- event:
+		default:
+			h.remove(l, ErrListenerTooSlow)
+		}
+	}
+}
+
+// Listen registers a listener for the events of a channel. Close it when
+// done.
+func (h *Hub) Listen(channelID uuid.UUID) (*Listener, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+
+	c := make(chan model.Event, listenerBuffer)
+	l := &Listener{C: c, c: c, hub: h, channelID: channelID}
+
+	if h.listeners[channelID] == nil {
+		h.listeners[channelID] = make(map[*Listener]struct{})
+	}
+	h.listeners[channelID][l] = struct{}{}
+
+	return l, nil
+}
+
+// Close drops every listener with ErrHubClosed and refuses new ones.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, listeners := range h.listeners {
+		for l := range listeners {
+			h.remove(l, ErrHubClosed)
+		}
+	}
+}
+
+// remove unregisters l and closes its channel. It is called with h.mu held.
+func (h *Hub) remove(l *Listener, err error) {
+	listeners := h.listeners[l.channelID]
+	if _, ok := listeners[l]; !ok {
+		return
+	}
+
+	delete(listeners, l)
+	if len(listeners) == 0 {
+		delete(h.listeners, l.channelID)
+	}
+
+	l.err = err
+	close(l.c)
+}
+
+// Close unregisters the listener. It is safe to call more than once.
+func (l *Listener) Close() {
+	l.hub.mu.Lock()
+	defer l.hub.mu.Unlock()
+
+	l.hub.remove(l, nil)
+}
+
+// Err reports why C was closed: ErrListenerTooSlow, ErrHubClosed, or nil if
+// the listener was closed by its owner or is still open.
+func (l *Listener) Err() error {
+	l.hub.mu.Lock()
+	defer l.hub.mu.Unlock()
+
+	return l.err
+}
@@ -0,0 +1,347 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const memoryQueueSize = 1024
+
+// Memory is an in-process Broker for tests and single-node deployments. It
+// routes like the RabbitMQ topic exchange described by its Topology, with
+// the same retry and dead-letter behaviour, but messages only live as long
+// as the process.
+type Memory struct {
+	topology Topology
+
+	mu       sync.RWMutex
+	queues   map[string]chan memoryDelivery
+	bindings []Binding
+	closed   bool
+	done     chan struct{}
+}
+
+type memoryDelivery struct {
+	body        []byte
+	contentType string
+	routingKey  string
+	retries     int
+}
+
+func NewMemory(topology Topology) *Memory {
+	m := &Memory{
+		topology: topology,
+		queues:   make(map[string]chan memoryDelivery),
+		bindings: slices.Clone(topology.Bindings),
+		done:     make(chan struct{}),
+	}
+
+	for _, b := range topology.Bindings {
+		m.queue(b.Queue)
+	}
+
+	return m
+}
+
+// queue returns the named queue, creating it if needed. It is called with
+// m.mu held for writing.
+func (m *Memory) queue(name string) chan memoryDelivery {
+	q, ok := m.queues[name]
+	if !ok {
+		q = make(chan memoryDelivery, memoryQueueSize)
+		m.queues[name] = q
+	}
+	return q
+}
+
+func (m *Memory) State() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return Closed
+	}
+	return Connected
+}
+
+// Publish copies body into every queue bound to routingKey. Like the
+// RabbitMQ publisher it fails with an *UnroutableError when no queue is
+// bound, and it waits for room in a full queue until ctx is done.
+func (m *Memory) Publish(ctx context.Context, routingKey, contentType string, body []byte) error {
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return ErrClosed
+	}
+
+	var targets []chan memoryDelivery
+	if m.topology.Exchange == "" {
+		if q, ok := m.queues[routingKey]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		for _, b := range m.bindings {
+			q := m.queues[b.Queue]
+			if matchTopic(b.BindingKey, routingKey) && !slices.Contains(targets, q) {
+				targets = append(targets, q)
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	if len(targets) == 0 {
+		return &UnroutableError{
+			Exchange:   m.topology.Exchange,
+			RoutingKey: routingKey,
+			ReplyCode:  312,
+			ReplyText:  "NO_ROUTE",
+		}
+	}
+
+	d := memoryDelivery{body: slices.Clone(body), contentType: contentType, routingKey: routingKey}
+	for _, q := range targets {
+		select {
+		case q <- d:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to publish message: %w", ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+// Subscribe delivers the messages of queue to handler until ctx is cancelled
+// or the broker is closed. The queue is created if it doesn't exist.
+func (m *Memory) Subscribe(ctx context.Context, queue string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	q := m.queue(queue)
+	m.mu.Unlock()
+
+	s := &memorySubscriber{
+		broker:  m,
+		queue:   queue,
+		q:       q,
+		handler: handler,
+		options: options.withDefaults(),
+		ctx:     ctx,
+	}
+	sub := &subscription{done: make(chan struct{})}
+
+	go func() {
+		s.run()
+		close(sub.done)
+	}()
+
+	return sub, nil
+}
+
+// SubscribeTopic binds a queue of the subscription's own to bindingKey and
+// removes it again once the subscription ends.
+func (m *Memory) SubscribeTopic(ctx context.Context, bindingKey string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	queue := fmt.Sprintf("%s.listener.%s", m.topology.Exchange, uuid.NewString())
+	binding := Binding{Queue: queue, BindingKey: bindingKey}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	q := m.queue(queue)
+	m.bindings = append(m.bindings, binding)
+	m.mu.Unlock()
+
+	s := &memorySubscriber{
+		broker:    m,
+		queue:     queue,
+		q:         q,
+		transient: true,
+		handler:   handler,
+		options:   options.withDefaults(),
+		ctx:       ctx,
+	}
+	sub := &subscription{done: make(chan struct{})}
+
+	go func() {
+		s.run()
+
+		m.mu.Lock()
+		m.bindings = slices.DeleteFunc(m.bindings, func(b Binding) bool {
+			return b == binding
+		})
+		delete(m.queues, queue)
+		m.mu.Unlock()
+
+		close(sub.done)
+	}()
+
+	return sub, nil
+}
+
+// Close stops every subscription. Messages still queued are lost.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+	return nil
+}
+
+type memorySubscriber struct {
+	broker *Memory
+	queue  string
+	q      chan memoryDelivery
+	// transient subscribers have no retries or dead letters.
+	transient bool
+	handler   Handler
+	options   ConsumeOptions
+	ctx       context.Context
+}
+
+func (s *memorySubscriber) run() {
+	// inFlight caps the messages taken off the queue but not yet handled,
+	// like the prefetch window does for RabbitMQ.
+	inFlight := make(chan struct{}, s.options.Prefetch)
+
+	var wg sync.WaitGroup
+	workers := make([]chan memoryDelivery, s.options.Workers)
+	for i := range workers {
+		workers[i] = make(chan memoryDelivery, s.options.Prefetch)
+
+		wg.Add(1)
+		go func(in <-chan memoryDelivery) {
+			defer wg.Done()
+			for d := range in {
+				s.handle(d)
+				<-inFlight
+			}
+		}(workers[i])
+	}
+
+loop:
+	for {
+		select {
+		case inFlight <- struct{}{}:
+		case <-s.ctx.Done():
+			break loop
+		case <-s.broker.done:
+			break loop
+		}
+
+		select {
+		case d := <-s.q:
+			workers[workerFor(s.options.Key(d.delivery()), len(workers))] <- d
+		case <-s.ctx.Done():
+			break loop
+		case <-s.broker.done:
+			break loop
+		}
+	}
+
+	for _, w := range workers {
+		close(w)
+	}
+	wg.Wait()
+}
+
+// delivery is d as handlers see it. Published messages carry no reply-to,
+// so there is nothing to reply to.
+func (d memoryDelivery) delivery() Delivery {
+	return Delivery{Body: d.body, ContentType: d.contentType, RoutingKey: d.routingKey}
+}
+
+func (s *memorySubscriber) handle(d memoryDelivery) {
+	err := s.handler(context.WithoutCancel(s.ctx), d.delivery())
+	if err == nil {
+		return
+	}
+
+	if s.transient {
+		log.Printf("Dropping message from %s: %v", s.queue, err)
+		return
+	}
+
+	if errors.Is(err, ErrUnprocessable) {
+		log.Printf("Dead-lettering message from %s: %v", s.queue, err)
+		s.deadLetter(d)
+		return
+	}
+
+	if d.retries >= s.options.MaxRetries {
+		log.Printf("Dead-lettering message from %s after %d retries: %v", s.queue, d.retries, err)
+		s.deadLetter(d)
+		return
+	}
+
+	log.Printf("Retrying message from %s in %s: %v", s.queue, s.options.RetryDelay, err)
+
+	d.retries++
+	time.AfterFunc(s.options.RetryDelay, func() {
+		select {
+		case s.q <- d:
+		default:
+			log.Printf("Dropping retry for %s: queue is full", s.queue)
+		}
+	})
+}
+
+// deadLetter moves d to "<queue>.dead" when the topology has a dead-letter
+// exchange, and drops it otherwise.
+func (s *memorySubscriber) deadLetter(d memoryDelivery) {
+	if s.broker.topology.DeadLetterExchange == "" {
+		return
+	}
+
+	s.broker.mu.Lock()
+	q := s.broker.queue(s.queue + ".dead")
+	s.broker.mu.Unlock()
+
+	select {
+	case q <- d:
+	default:
+		log.Printf("Dropping dead letter for %s: queue is full", s.queue)
+	}
+}
+
+// matchTopic reports whether key matches a topic binding pattern, where "*"
+// stands for exactly one word and "#" for zero or more.
+func matchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	if pattern[0] == "#" {
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(key) == 0 {
+		return false
+	}
+	if pattern[0] != "*" && pattern[0] != key[0] {
+		return false
+	}
+	return matchWords(pattern[1:], key[1:])
+}
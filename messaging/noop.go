@@ -0,0 +1,42 @@
+package messaging
+
+import (
+	"context"
+)
+
+// Noop is a Broker that discards everything published to it and never
+// delivers anything, for deployments that don't need events.
+type Noop struct{}
+
+func (Noop) Publish(ctx context.Context, routingKey, contentType string, body []byte) error {
+	return nil
+}
+
+func (Noop) Subscribe(ctx context.Context, queue string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	s := &subscription{done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+func (n Noop) SubscribeTopic(ctx context.Context, bindingKey string, handler Handler, options ConsumeOptions) (Subscription, error) {
+	return n.Subscribe(ctx, bindingKey, handler, options)
+}
+
+func (Noop) State() State {
+	return Connected
+}
+
+func (Noop) Close() error {
+	return nil
+}
+
+type subscription struct {
+	done chan struct{}
+}
+
+func (s *subscription) Done() <-chan struct{} {
+	return s.done
+}
@@ -0,0 +1,257 @@
+package messaging
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// ProtobufCodec encodes events as the message.v1.Event protobuf described in
+// schema/event.proto. Unknown fields are skipped, so consumers keep working
+// when fields are added.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Encode(event model.Event) ([]byte, error) {
+	var b []byte
+	b = appendUint(b, 1, uint64(event.SchemaVersion))
+	b = appendUUID(b, 2, event.EventID)
+	b = appendString(b, 3, string(event.Type))
+	b = appendUUID(b, 4, event.MessageID)
+	b = appendUUID(b, 5, event.ChannelID)
+	b = appendTime(b, 6, &event.OccurredAt)
+
+	p := event.Payload
+	var payload []byte
+	payload = appendUUID(payload, 1, p.MessageID)
+	payload = appendUUID(payload, 2, p.ChannelID)
+	if p.ParentID != nil {
+		payload = appendUUID(payload, 3, *p.ParentID)
+	}
+	payload = appendUUID(payload, 4, p.UserID)
+	payload = appendString(payload, 5, p.MessageText)
+	payload = appendTime(payload, 6, p.CreatedAt)
+	payload = appendTime(payload, 7, p.UpdatedAt)
+	payload = appendBool(payload, 8, p.Edited)
+	payload = appendBool(payload, 9, p.Deleted)
+	payload = appendUint(payload, 10, uint64(p.Version))
+
+	b = protowire.AppendTag(b, 7, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	b = appendString(b, 8, event.StreamID)
+
+	if pr := event.Presence; pr != nil {
+		var presence []byte
+		presence = appendString(presence, 1, string(pr.Kind))
+		presence = appendUUID(presence, 2, pr.ChannelID)
+		presence = appendUUID(presence, 3, pr.UserID)
+		presence = appendTime(presence, 4, &pr.ExpiresAt)
+
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, presence)
+	}
+
+	return b, nil
+}
+
+func (ProtobufCodec) Decode(data []byte) (model.Event, error) {
+	var event model.Event
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			event.SchemaVersion = int(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeUUID(b, &event.EventID)
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			event.Type = model.EventType(v)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			return consumeUUID(b, &event.MessageID)
+		case num == 5 && typ == protowire.BytesType:
+			return consumeUUID(b, &event.ChannelID)
+		case num == 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			event.OccurredAt = time.UnixMicro(int64(v)).UTC()
+			return n, nil
+		case num == 7 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			return n, decodePayload(v, &event.Payload)
+		case num == 8 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			event.StreamID = v
+			return n, nil
+		case num == 9 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			event.Presence = &model.Presence{}
+			return n, decodePresence(v, event.Presence)
+		default:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+	})
+	if err != nil {
+		return model.Event{}, err
+	}
+
+	return upgrade(event)
+}
+
+func decodePayload(data []byte, p *model.EventPayload) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeUUID(b, &p.MessageID)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeUUID(b, &p.ChannelID)
+		case num == 3 && typ == protowire.BytesType:
+			var id uuid.UUID
+			n, err := consumeUUID(b, &id)
+			p.ParentID = &id
+			return n, err
+		case num == 4 && typ == protowire.BytesType:
+			return consumeUUID(b, &p.UserID)
+		case num == 5 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			p.MessageText = v
+			return n, nil
+		case num == 6 && typ == protowire.VarintType:
+			return consumeTime(b, &p.CreatedAt)
+		case num == 7 && typ == protowire.VarintType:
+			return consumeTime(b, &p.UpdatedAt)
+		case num == 8 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Edited = protowire.DecodeBool(v)
+			return n, nil
+		case num == 9 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Deleted = protowire.DecodeBool(v)
+			return n, nil
+		case num == 10 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.Version = int64(v)
+			return n, nil
+		default:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+	})
+}
+
+func decodePresence(data []byte, p *model.Presence) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			p.Kind = model.PresenceKind(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeUUID(b, &p.ChannelID)
+		case num == 3 && typ == protowire.BytesType:
+			return consumeUUID(b, &p.UserID)
+		case num == 4 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.ExpiresAt = time.UnixMicro(int64(v)).UTC()
+			return n, nil
+		default:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+	})
+}
+
+// consumeFields walks the fields of an encoded message, handing each value
+// to field, which reports how many bytes it read.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("failed to decode event: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("failed to decode event field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeUUID(b []byte, id *uuid.UUID) (int, error) {
+	v, n := protowire.ConsumeString(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	parsed, err := uuid.Parse(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode event: %w", err)
+	}
+	*id = parsed
+	return n, nil
+}
+
+func consumeTime(b []byte, t **time.Time) (int, error) {
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	parsed := time.UnixMicro(int64(v)).UTC()
+	*t = &parsed
+	return n, nil
+}
+
+// The append helpers leave out zero values, as proto3 does.
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendUint(b, num, protowire.EncodeBool(v))
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendUUID(b []byte, num protowire.Number, id uuid.UUID) []byte {
+	if id == uuid.Nil {
+		return b
+	}
+	return appendString(b, num, id.String())
+}
+
+func appendTime(b []byte, num protowire.Number, t *time.Time) []byte {
+	if t == nil || t.IsZero() {
+		return b
+	}
+	return appendUint(b, num, uint64(t.UnixMicro()))
+}
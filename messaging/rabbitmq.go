@@ -1,125 +1,465 @@
 package messaging
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/rabbitmq/amqp091-go"
-	"github.com/CatalinPlesu/message-service/model"
 )
 
+var (
+	ErrNacked       = errors.New("message was nacked by the broker")
+	ErrNotConnected = errors.New("rabbitmq is not connected")
+	ErrClosed       = errors.New("rabbitmq connection is closed")
+)
+
+// UnroutableError is returned by Publish when the broker accepted a message
+// but no queue was bound to receive it.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to %q with routing key %q was returned: %d %s", e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+type State int32
+
+const (
+	Disconnected State = iota
+	Connected
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Closed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// Topology is what the service declares every time it (re)connects.
+type Topology struct {
+	// Exchange is the topic exchange Publish sends to. When empty, Publish
+	// uses the default exchange and the routing key names a queue.
+	Exchange        string
+	DeclareExchange bool
+	// DeadLetterExchange receives messages consumers reject for good. Every
+	// queue declared here gets a "<queue>.dead" queue bound to it. When
+	// empty, rejected messages are dropped.
+	DeadLetterExchange string
+	Bindings           []Binding
+}
+
+type Binding struct {
+	Queue      string
+	BindingKey string
+}
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// RabbitMQ is a supervised connection. A background goroutine dials the
+// broker, declares the topology and starts registered consumers, then
+// watches for the connection or channel closing and starts over with
+// exponential backoff. While it is down, Publish fails fast with
+// ErrNotConnected.
 type RabbitMQ struct {
-	Connection *amqp091.Connection
-	Channel    *amqp091.Channel
+	url      string
+	topology Topology
+	state    atomic.Int32
+	done     chan struct{}
+	once     sync.Once
+
+	mu        sync.RWMutex
+	conn      *amqp091.Connection
+	ch        *amqp091.Channel
+	returns   chan amqp091.Return
+	consumers []*Consumer
+
+	// Publishes are serialised so the basic.return for a message, which
+	// the broker sends before its ack, is always in returns by the time the
+	// publisher sees the confirm.
+	publishMu sync.Mutex
+}
+
+func NewRabbitMQ(rabbitMQURL string, topology Topology) *RabbitMQ {
+	r := &RabbitMQ{
+		url:      rabbitMQURL,
+		topology: topology,
+		done:     make(chan struct{}),
+	}
+
+	go r.supervise()
+
+	return r
 }
 
-func NewRabbitMQ(rabbitMQURL string) (*RabbitMQ, error) {
-	conn, err := amqp091.Dial(rabbitMQURL)
+func (r *RabbitMQ) State() State {
+	return State(r.state.Load())
+}
+
+func (r *RabbitMQ) supervise() {
+	delay := minReconnectDelay
+
+	for {
+		closed, err := r.connect()
+		if errors.Is(err, ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("RabbitMQ connection failed, retrying in %s: %v", delay, err)
+
+			select {
+			case <-r.done:
+				return
+			case <-time.After(delay):
+			}
+
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+
+		delay = minReconnectDelay
+		log.Printf("Connected to RabbitMQ")
+
+		select {
+		case <-r.done:
+			return
+		case err := <-closed:
+			r.disconnect()
+			log.Printf("Lost RabbitMQ connection: %v", err)
+		}
+	}
+}
+
+// connect dials the broker and brings the channel to a usable state. The
+// returned channel yields once the connection or the channel closes.
+func (r *RabbitMQ) connect() (<-chan *amqp091.Error, error) {
+	conn, err := amqp091.Dial(r.url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to open a channel: %w", err)
 	}
 
-	return &RabbitMQ{
-		Connection: conn,
-		Channel:    ch,
-	}, nil
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	if err := declareTopology(ch, r.topology); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connClosed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+
+	for _, c := range r.consumers {
+		if err := c.start(conn, r.topology); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	r.conn = conn
+	r.ch = ch
+	r.returns = ch.NotifyReturn(make(chan amqp091.Return, 16))
+	r.state.Store(int32(Connected))
+
+	closed := make(chan *amqp091.Error, 1)
+	go func() {
+		select {
+		case err := <-connClosed:
+			closed <- err
+		case err := <-chClosed:
+			// A channel-level error leaves the connection open; drop it so
+			// the next attempt starts clean.
+			conn.Close()
+			closed <- err
+		}
+	}()
+
+	return closed, nil
+}
+
+func (r *RabbitMQ) disconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conn = nil
+	r.ch = nil
+	r.returns = nil
+	if r.State() != Closed {
+		r.state.Store(int32(Disconnected))
+	}
+}
+
+func declareTopology(ch *amqp091.Channel, t Topology) error {
+	if t.DeclareExchange {
+		err := ch.ExchangeDeclare(
+			t.Exchange,
+			amqp091.ExchangeTopic,
+			true,  // Durable
+			false, // Auto delete
+			false, // Internal
+			false, // No-wait
+			nil,   // Arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange: %w", err)
+		}
+	}
+
+	if t.DeadLetterExchange != "" {
+		err := ch.ExchangeDeclare(
+			t.DeadLetterExchange,
+			amqp091.ExchangeDirect,
+			true,  // Durable
+			false, // Auto delete
+			false, // Internal
+			false, // No-wait
+			nil,   // Arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare dead-letter exchange: %w", err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		if err := declareQueue(ch, t, b.Queue); err != nil {
+			return err
+		}
+
+		err := ch.QueueBind(
+			b.Queue,
+			b.BindingKey,
+			t.Exchange,
+			false, // No-wait
+			nil,   // Arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue: %w", err)
+		}
+	}
+
+	return nil
 }
 
-// Publish a message to the RabbitMQ queue
-func (r *RabbitMQ) PublishMessage(queueName string, message model.MessageMin) error {
-	body, err := json.Marshal(message)
+// declareQueue declares a queue together with its "<queue>.retry" queue,
+// which dead-letters expired messages back into the queue, and, when the
+// topology has a dead-letter exchange, its "<queue>.dead" queue.
+func declareQueue(ch *amqp091.Channel, t Topology, name string) error {
+	var args amqp091.Table
+	if t.DeadLetterExchange != "" {
+		args = amqp091.Table{
+			"x-dead-letter-exchange":    t.DeadLetterExchange,
+			"x-dead-letter-routing-key": name,
+		}
+	}
+
+	if err := queueDeclare(ch, name, args); err != nil {
+		return err
+	}
+
+	err := queueDeclare(ch, name+".retry", amqp091.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": name,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return err
 	}
 
-	// Declare the queue if it doesn't exist
-	_, err = r.Channel.QueueDeclare(
-		queueName,
-		true,  // Durable
-		false, // Auto delete
-		false, // Exclusive
+	if t.DeadLetterExchange == "" {
+		return nil
+	}
+
+	if err := queueDeclare(ch, name+".dead", nil); err != nil {
+		return err
+	}
+
+	err = ch.QueueBind(
+		name+".dead",
+		name,
+		t.DeadLetterExchange,
 		false, // No-wait
 		nil,   // Arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return fmt.Errorf("failed to bind dead-letter queue: %w", err)
 	}
+	return nil
+}
 
-	// Publish the message to the queue
-	err = r.Channel.Publish(
-		"",         // Default exchange
-		queueName,  // Routing key (queue name)
-		false,      // Mandatory
-		false,      // Immediate
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
+// declareTopicQueue declares a queue that only exists while its consumer
+// does, and binds it to the exchange.
+func declareTopicQueue(ch *amqp091.Channel, t Topology, name, bindingKey string) error {
+	_, err := ch.QueueDeclare(
+		name,
+		false, // Durable
+		true,  // Auto delete
+		true,  // Exclusive
+		false, // No-wait
+		nil,   // Arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
+		return fmt.Errorf("failed to declare queue %s: %w", name, err)
 	}
 
-	log.Printf("Published message to queue %s: %s", queueName, body)
+	err = ch.QueueBind(
+		name,
+		bindingKey,
+		t.Exchange,
+		false, // No-wait
+		nil,   // Arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s: %w", name, err)
+	}
 	return nil
 }
 
-// Consume messages from the RabbitMQ queue
-func (r *RabbitMQ) ConsumeMessages(queueName string, handler func(model.MessageMin)) error {
-	// Declare the queue if it doesn't exist
-	_, err := r.Channel.QueueDeclare(
-		queueName,
+func queueDeclare(ch *amqp091.Channel, name string, args amqp091.Table) error {
+	_, err := ch.QueueDeclare(
+		name,
 		true,  // Durable
 		false, // Auto delete
 		false, // Exclusive
 		false, // No-wait
-		nil,   // Arguments
+		args,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+		return fmt.Errorf("failed to declare queue %s: %w", name, err)
 	}
+	return nil
+}
 
-	// Consume messages from the queue
-	msgs, err := r.Channel.Consume(
-		queueName,
-		"",
-		true,  // Auto-acknowledge messages
-		false, // Exclusive
-		false, // No-local
-		false, // No-wait
-		nil,   // Arguments
+// Publish an already encoded body under the given routing key and wait for
+// the broker to confirm it. The message is mandatory: if nothing is bound
+// to receive it the error is an *UnroutableError. ctx bounds the wait.
+func (r *RabbitMQ) Publish(ctx context.Context, routingKey, contentType string, body []byte) error {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+
+	r.mu.RLock()
+	ch, returns := r.ch, r.returns
+	r.mu.RUnlock()
+
+	if ch == nil {
+		if r.State() == Closed {
+			return ErrClosed
+		}
+		return ErrNotConnected
+	}
+
+	id := uuid.NewString()
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		r.topology.Exchange,
+		routingKey,
+		true,  // Mandatory
+		false, // Immediate
+		amqp091.Publishing{
+			ContentType:  contentType,
+			DeliveryMode: amqp091.Persistent,
+			MessageId:    id,
+			Body:         body,
+		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to register a consumer: %w", err)
+		return fmt.Errorf("failed to publish message: %w", err)
 	}
 
-	// Process messages asynchronously
-	go func() {
-		for d := range msgs {
-			var message model.MessageMin
-			if err := json.Unmarshal(d.Body, &message); err != nil {
-				log.Printf("Failed to unmarshal message: %v", err)
-				continue
-			}
-			handler(message) // Call the handler with the decoded message
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for publisher confirm: %w", err)
+	}
+
+	if ret, ok := takeReturn(returns, id); ok {
+		return &UnroutableError{
+			Exchange:   ret.Exchange,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
 		}
-	}()
+	}
 
-	log.Printf("Started consuming messages from queue %s", queueName)
+	if !acked {
+		return ErrNacked
+	}
+
+	log.Printf("Published %s message to %s/%s", contentType, r.topology.Exchange, routingKey)
 	return nil
 }
 
+// takeReturn drains pending basic.returns and reports whether one of them
+// was for the message with the given ID. Returns for other messages belong
+// to publishes that already gave up waiting and are dropped.
+func takeReturn(returns chan amqp091.Return, id string) (amqp091.Return, bool) {
+	var found amqp091.Return
+	ok := false
+
+	for {
+		select {
+		case ret := <-returns:
+			if ret.MessageId == id {
+				found, ok = ret, true
+			}
+		default:
+			return found, ok
+		}
+	}
+}
+
+// Close stops the supervisor and closes the connection. The RabbitMQ cannot
+// be used afterwards.
 func (r *RabbitMQ) Close() error {
-	if err := r.Channel.Close(); err != nil {
-		return fmt.Errorf("failed to close channel: %w", err)
+	r.once.Do(func() {
+		close(r.done)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Store(int32(Closed))
+
+	conn := r.conn
+	r.conn, r.ch, r.returns = nil, nil, nil
+
+	if conn == nil {
+		return nil
 	}
-	if err := r.Connection.Close(); err != nil {
+	if err := conn.Close(); err != nil && !errors.Is(err, amqp091.ErrClosed) {
 		return fmt.Errorf("failed to close connection: %w", err)
 	}
 	return nil
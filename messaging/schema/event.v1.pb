@@ -0,0 +1,2 @@
+$0f8b6f5e-7c1a-4b7e-8d2c-5a9e3b1c4d60message.updated"$9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182*$1b2c3d4e-5f60-4718-92a3-b4c5d6e7f8090î:
+$9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182$1b2c3d4e-5f60-4718-92a3-b4c5d6e7f809$4a1f6c1e-2d6b-4c38-9a57-0d1f0e2b7c11"$7e6d5c4b-3a29-4180-b7c6-d5e4f3a2b190*hello, world08î@P
\ No newline at end of file
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS messages (
+    message_id   UUID PRIMARY KEY,
+    channel_id   UUID,
+    parent_id    UUID,
+    user_id      UUID,
+    message_text VARCHAR,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT current_timestamp
+);
@@ -0,0 +1,5 @@
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_parent_id_fkey;
+
+DROP INDEX IF EXISTS messages_created_idx;
+DROP INDEX IF EXISTS messages_parent_created_idx;
+DROP INDEX IF EXISTS messages_channel_created_idx;
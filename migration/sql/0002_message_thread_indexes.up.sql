@@ -0,0 +1,19 @@
+-- Keyset listings filter on channel or parent and walk (created_at, message_id).
+CREATE INDEX IF NOT EXISTS messages_channel_created_idx
+    ON messages (channel_id, created_at, message_id);
+
+CREATE INDEX IF NOT EXISTS messages_parent_created_idx
+    ON messages (parent_id, created_at, message_id)
+    WHERE parent_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS messages_created_idx
+    ON messages (created_at, message_id);
+
+-- A message with replies cannot be hard-deleted out from under its thread.
+-- NOT VALID keeps rows written before the constraint existed, some of which
+-- may already point at deleted parents; new writes are checked.
+ALTER TABLE messages
+    ADD CONSTRAINT messages_parent_id_fkey
+    FOREIGN KEY (parent_id) REFERENCES messages (message_id)
+    ON DELETE RESTRICT
+    NOT VALID;
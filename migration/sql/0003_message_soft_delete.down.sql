@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS messages_deleted_at_idx;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS deleted_by,
+    DROP COLUMN IF EXISTS deleted_at;
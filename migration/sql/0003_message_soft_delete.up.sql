@@ -0,0 +1,8 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS deleted_by UUID;
+
+-- Only tombstones are scanned by the purge job.
+CREATE INDEX IF NOT EXISTS messages_deleted_at_idx
+    ON messages (deleted_at)
+    WHERE deleted_at IS NOT NULL;
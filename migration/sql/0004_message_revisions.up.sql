@@ -0,0 +1,12 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS edited BOOLEAN NOT NULL DEFAULT false;
+
+-- Each row keeps the text a message had before edit number "revision".
+CREATE TABLE IF NOT EXISTS message_revisions (
+    message_id   UUID NOT NULL REFERENCES messages (message_id) ON DELETE CASCADE,
+    revision     INTEGER NOT NULL,
+    message_text VARCHAR,
+    edited_by    UUID,
+    edited_at    TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (message_id, revision)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+ALTER TABLE outbox RENAME COLUMN routing_key TO queue;
@@ -0,0 +1,2 @@
+-- Outbox rows are now published to the events topic exchange by routing key.
+ALTER TABLE outbox RENAME COLUMN queue TO routing_key;
@@ -0,0 +1,9 @@
+-- Events that keep failing are set aside after a number of attempts rather
+-- than retried forever.
+ALTER TABLE outbox
+    ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx
+    ON outbox (next_attempt_at, id)
+    WHERE sent_at IS NULL AND dead_at IS NULL;
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"github.com/google/uuid"
+)
+
+// CreateMessageCommand asks the service to post a message. ClientID is
+// chosen by the sender and becomes the message ID, so a command delivered
+// more than once creates one message.
+type CreateMessageCommand struct {
+	ClientID    uuid.UUID  `json:"client_id"`
+	ChannelID   uuid.UUID  `json:"channel_id"`
+	ParentID    *uuid.UUID `json:"parent_id,omitempty"`
+	UserID      uuid.UUID  `json:"user_id"`
+	MessageText string     `json:"message"`
+}
+
+type CommandStatus string
+
+const (
+	CommandCreated   CommandStatus = "created"
+	CommandDuplicate CommandStatus = "duplicate"
+	CommandRejected  CommandStatus = "rejected"
+)
+
+// CommandReply is sent to the command's reply-to queue once it is handled.
+type CommandReply struct {
+	ClientID uuid.UUID     `json:"client_id"`
+	Status   CommandStatus `json:"status"`
+	Message  *Message      `json:"message,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventType string
+
+const (
+	MessageCreated  EventType = "message.created"
+	MessageUpdated  EventType = "message.updated"
+	MessageDeleted  EventType = "message.deleted"
+	MessageRestored EventType = "message.restored"
+
+	UserOnline        EventType = "presence.online"
+	UserOffline       EventType = "presence.offline"
+	UserTyping        EventType = "presence.typing"
+	UserStoppedTyping EventType = "presence.stopped_typing"
+)
+
+// EventSchemaVersion is the version of Event this build publishes. Bump it
+// for changes old consumers cannot ignore, and keep decoding the versions
+// before it; adding fields does not need a bump.
+//
+// Version 0 is the envelope before schema_version existed, whose payload
+// had no message_id, version or state flags.
+const EventSchemaVersion = 1
+
+// Event is the envelope published for every change to a message. EventID is
+// unique per event so consumers can drop redeliveries. StreamID is the
+// event's position in its channel's event log, set once it has been logged;
+// it grows with every event of a channel. Presence events carry Presence
+// instead of a message.
+type Event struct {
+	SchemaVersion int          `json:"schema_version"`
+	EventID       uuid.UUID    `json:"event_id"`
+	Type          EventType    `json:"type"`
+	MessageID     uuid.UUID    `json:"message_id"`
+	ChannelID     uuid.UUID    `json:"channel_id"`
+	OccurredAt    time.Time    `json:"occurred_at"`
+	Payload       EventPayload `json:"payload"`
+	StreamID      string       `json:"stream_id,omitempty"`
+	Presence      *Presence    `json:"presence,omitempty"`
+}
+
+// EventPayload is the message as it was right after the change.
+type EventPayload struct {
+	MessageID   uuid.UUID  `json:"message_id"`
+	ChannelID   uuid.UUID  `json:"channel_id"`
+	ParentID    *uuid.UUID `json:"parent_id,omitempty"`
+	UserID      uuid.UUID  `json:"user_id"`
+	MessageText string     `json:"message_text"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	Edited      bool       `json:"edited"`
+	Deleted     bool       `json:"deleted"`
+	Version     int64      `json:"version"`
+}
+
+// RoutingKey is the topic the event is published under,
+// message.<event>.<channel_id>, e.g. message.created.<uuid>. Consumers bind
+// with patterns such as message.*.<channel_id> or message.deleted.#.
+func (e Event) RoutingKey() string {
+	return fmt.Sprintf("%s.%s", e.Type, e.ChannelID)
+}
+
+// NewEvent describes a change to m. The payload is the message as clients
+// see it, so a deleted message carries no text.
+func NewEvent(eventType EventType, m Message, occurredAt time.Time) Event {
+	m = m.Redacted()
+
+	return Event{
+		SchemaVersion: EventSchemaVersion,
+		EventID:       uuid.New(),
+		Type:          eventType,
+		MessageID:     m.MessageID,
+		ChannelID:     m.ChannelID,
+		OccurredAt:    occurredAt.UTC(),
+		Payload: EventPayload{
+			MessageID:   m.MessageID,
+			ChannelID:   m.ChannelID,
+			ParentID:    m.ParentID,
+			UserID:      m.UserID,
+			MessageText: m.MessageText,
+			CreatedAt:   m.CreatedAt,
+			UpdatedAt:   m.UpdatedAt,
+			Edited:      m.Edited,
+			Deleted:     m.DeletedAt != nil,
+			Version:     m.Version,
+		},
+	}
+}
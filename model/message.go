@@ -10,20 +10,35 @@ import (
 type Message struct {
 	bun.BaseModel `bun:"table:messages"` // This tells Bun ORM to use the "messages" table.
 
-	MessageID   uuid.UUID  `bun:"message_id,pk,type:uuid"` // Primary key, using UUID type.
-	ChannelID   uuid.UUID  `bun:"channel_id,type:uuid"`    // Foreign key, using UUID type.
-	ParentID    *uuid.UUID `bun:"parent_id,nullzero,type:uuid"` // Nullable field for parent ID.
-	UserID      uuid.UUID  `bun:"user_id,type:uuid"`       // Foreign key, using UUID type.
-	MessageText string     `bun:"message_text"`            // Column for the message content.
+	MessageID   uuid.UUID  `bun:"message_id,pk,type:uuid"`                      // Primary key, using UUID type.
+	ChannelID   uuid.UUID  `bun:"channel_id,type:uuid"`                         // Foreign key, using UUID type.
+	ParentID    *uuid.UUID `bun:"parent_id,nullzero,type:uuid"`                 // Nullable field for parent ID.
+	UserID      uuid.UUID  `bun:"user_id,type:uuid"`                            // Foreign key, using UUID type.
+	MessageText string     `bun:"message_text"`                                 // Column for the message content.
 	CreatedAt   *time.Time `bun:"created_at,notnull,default:current_timestamp"` // Timestamp with default value.
 	UpdatedAt   *time.Time `bun:"updated_at,notnull,default:current_timestamp"` // Timestamp with default value.
+	DeletedAt   *time.Time `bun:"deleted_at,nullzero"`                          // Set while the message is a tombstone.
+	DeletedBy   *uuid.UUID `bun:"deleted_by,nullzero,type:uuid"`                // User who deleted the message, if known.
+	Edited      bool       `bun:"edited,notnull,default:false"`                 // Set once the text has been changed.
+	Version     int64      `bun:"version,notnull,default:1"`                    // Bumped on every write, used for ETags.
 }
 
+// Redacted returns the message as clients see it. A deleted message keeps its
+// place in the channel and thread but its text is withheld.
+func (m Message) Redacted() Message {
+	if m.DeletedAt != nil {
+		m.MessageText = ""
+	}
+	return m
+}
+
+// MessageRevision is the text a message had before one of its edits.
+type MessageRevision struct {
+	bun.BaseModel `bun:"table:message_revisions"`
 
-type MessageMin struct {
-	ChannelID   uuid.UUID  `json:"channel_id"`   
-	ParentID    *uuid.UUID `json:"parent_id,omitempty"` 
-	UserID      uuid.UUID  `json:"user_id"`      
-	MessageText string     `json:"message_text"`  
-	CreatedAt   *time.Time `json:"created_at,omitempty"` 
+	MessageID   uuid.UUID  `bun:"message_id,pk,type:uuid"`
+	Revision    int        `bun:"revision,pk"`                  // 1 for the first edit, 2 for the second, ...
+	MessageText string     `bun:"message_text"`                 // Text before the edit.
+	EditedBy    *uuid.UUID `bun:"edited_by,nullzero,type:uuid"` // User who made the edit, if known.
+	EditedAt    time.Time  `bun:"edited_at,notnull"`
 }
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// OutboxEvent is an event waiting to be relayed to the message broker.
+type OutboxEvent struct {
+	bun.BaseModel `bun:"table:outbox"`
+
+	ID            int64      `bun:"id,pk,autoincrement"`
+	RoutingKey    string     `bun:"routing_key,notnull"`                               // Topic exchange routing key.
+	Payload       []byte     `bun:"payload,type:bytea,notnull"`                        // Encoded event body.
+	CreatedAt     time.Time  `bun:"created_at,notnull,default:current_timestamp"`      // When the event was recorded.
+	Attempts      int        `bun:"attempts,notnull,default:0"`                        // Failed publish attempts so far.
+	NextAttemptAt time.Time  `bun:"next_attempt_at,notnull,default:current_timestamp"` // Earliest time to try again.
+	LastError     string     `bun:"last_error,nullzero"`                               // Error from the last failed attempt.
+	SentAt        *time.Time `bun:"sent_at,nullzero"`                                  // Set once the broker has the event.
+	DeadAt        *time.Time `bun:"dead_at,nullzero"`                                  // Set once the event ran out of attempts.
+}
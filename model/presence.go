@@ -0,0 +1,50 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PresenceKind is a kind of ephemeral activity a user shows in a channel.
+type PresenceKind string
+
+const (
+	PresenceOnline PresenceKind = "online"
+	PresenceTyping PresenceKind = "typing"
+)
+
+// Presence says a user shows some activity in a channel until ExpiresAt,
+// unless they signal again. It is never persisted beyond that.
+type Presence struct {
+	Kind      PresenceKind `json:"kind"`
+	ChannelID uuid.UUID    `json:"channel_id"`
+	UserID    uuid.UUID    `json:"user_id"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// NewPresenceEvent describes p starting, when active, or ending. Presence
+// events share the message event envelope so the real-time transports can
+// carry them, but have no message and are never logged.
+func NewPresenceEvent(p Presence, active bool, occurredAt time.Time) Event {
+	var eventType EventType
+	switch {
+	case p.Kind == PresenceTyping && active:
+		eventType = UserTyping
+	case p.Kind == PresenceTyping:
+		eventType = UserStoppedTyping
+	case active:
+		eventType = UserOnline
+	default:
+		eventType = UserOffline
+	}
+
+	return Event{
+		SchemaVersion: EventSchemaVersion,
+		EventID:       uuid.New(),
+		Type:          eventType,
+		ChannelID:     p.ChannelID,
+		OccurredAt:    occurredAt.UTC(),
+		Presence:      &p,
+	}
+}
@@ -0,0 +1,310 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// CachedRepo is a read-through Redis cache in front of another Repository.
+// Single messages and the first page of each channel listing are cached for
+// TTL; writes go to the source and then drop the affected entries. Redis
+// failures are logged and fall back to the source.
+//
+// Every drop also bumps a generation kept next to the entry, and a read only
+// fills the cache if the generation is the one it saw before reading the
+// source. A read that raced a write therefore cannot cache what the write
+// replaced.
+type CachedRepo struct {
+	Source Repository
+	Client *redis.Client
+	TTL    time.Duration
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+var _ Repository = (*CachedRepo)(nil)
+
+func NewCachedRepo(source Repository, client *redis.Client, ttl time.Duration) *CachedRepo {
+	return &CachedRepo{
+		Source: source,
+		Client: client,
+		TTL:    ttl,
+	}
+}
+
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Errors uint64 `json:"errors"`
+}
+
+func (c *CachedRepo) Stats() CacheStats {
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Errors: c.errors.Load(),
+	}
+}
+
+func cachedMessageKey(id uuid.UUID) string {
+	return fmt.Sprintf("cache:message:%s", id.String())
+}
+
+// cachedChannelKey holds one hash field per page size, so invalidating a
+// channel is a single DEL.
+func cachedChannelKey(id uuid.UUID) string {
+	return fmt.Sprintf("cache:channel:%s", id.String())
+}
+
+func cachedGenerationKey(key string) string {
+	return key + ":generation"
+}
+
+// generationTTL is how long a generation outlives its last bump. A read of
+// the source that takes longer than this may still cache a stale value.
+const generationTTL = time.Hour
+
+var (
+	// invalidateScript drops each entry in KEYS and bumps the generation
+	// that follows it.
+	invalidateScript = redis.NewScript(`
+for i = 1, #KEYS, 2 do
+	redis.call('DEL', KEYS[i])
+	redis.call('INCR', KEYS[i + 1])
+	redis.call('PEXPIRE', KEYS[i + 1], ARGV[1])
+end
+return 0
+`)
+
+	// fillMessageScript caches a message unless its generation moved on.
+	fillMessageScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+	// fillPageScript caches a channel page unless the channel's generation
+	// moved on.
+	fillPageScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[4], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+)
+
+func (c *CachedRepo) Insert(ctx context.Context, message model.Message) error {
+	if err := c.Source.Insert(ctx, message); err != nil {
+		return err
+	}
+
+	c.invalidate(ctx, cachedChannelKey(message.ChannelID))
+	return nil
+}
+
+func (c *CachedRepo) FindByID(ctx context.Context, id uuid.UUID) (model.Message, error) {
+	key := cachedMessageKey(id)
+
+	var message model.Message
+	if c.get(ctx, c.Client.Get(ctx, key), &message) {
+		return message, nil
+	}
+
+	generation, fill := c.generation(ctx, key)
+
+	message, err := c.Source.FindByID(ctx, id)
+	if err != nil {
+		return model.Message{}, err
+	}
+
+	if data, ok := c.encode(message); ok && fill {
+		keys := []string{key, cachedGenerationKey(key)}
+		c.check(fillMessageScript.Run(ctx, c.Client, keys, generation, data, c.TTL.Milliseconds()).Err())
+	}
+
+	return message, nil
+}
+
+// FindCurrent reads a message from the source, for the version a write is
+// conditioned on, and drops any cached copy, which may be stale.
+func (c *CachedRepo) FindCurrent(ctx context.Context, id uuid.UUID) (model.Message, error) {
+	message, err := c.Source.FindByID(ctx, id)
+	if err != nil {
+		return model.Message{}, err
+	}
+
+	c.invalidate(ctx, cachedMessageKey(id))
+	return message, nil
+}
+
+func (c *CachedRepo) Update(ctx context.Context, message model.Message, editedBy *uuid.UUID) error {
+	if err := c.Source.Update(ctx, message, editedBy); err != nil {
+		c.invalidateStale(ctx, message.MessageID, err)
+		return err
+	}
+
+	c.invalidate(ctx, cachedMessageKey(message.MessageID), cachedChannelKey(message.ChannelID))
+	return nil
+}
+
+func (c *CachedRepo) Revisions(ctx context.Context, id uuid.UUID) ([]model.MessageRevision, error) {
+	return c.Source.Revisions(ctx, id)
+}
+
+func (c *CachedRepo) DeleteByID(ctx context.Context, id uuid.UUID, deletedBy *uuid.UUID, version int64) error {
+	if err := c.Source.DeleteByID(ctx, id, deletedBy, version); err != nil {
+		c.invalidateStale(ctx, id, err)
+		return err
+	}
+
+	c.invalidateMessage(ctx, id)
+	return nil
+}
+
+func (c *CachedRepo) Restore(ctx context.Context, id uuid.UUID) error {
+	if err := c.Source.Restore(ctx, id); err != nil {
+		c.invalidateStale(ctx, id, err)
+		return err
+	}
+
+	c.invalidateMessage(ctx, id)
+	return nil
+}
+
+// invalidateStale drops a cached message when a write to it failed because
+// the source disagrees with what the caller read. The cached copy can still
+// be stale if a drop failed or a read outlived generationTTL, and callers
+// that read through the cache would otherwise keep failing until the entry
+// expired.
+func (c *CachedRepo) invalidateStale(ctx context.Context, id uuid.UUID, err error) {
+	if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrNotExist) {
+		c.invalidate(ctx, cachedMessageKey(id))
+	}
+}
+
+// invalidateMessage drops a message and the cached page of its channel. The
+// message is still in the source as a tombstone, so its channel can be read
+// back after the write.
+func (c *CachedRepo) invalidateMessage(ctx context.Context, id uuid.UUID) {
+	c.invalidate(ctx, cachedMessageKey(id))
+
+	message, err := c.Source.FindByID(ctx, id)
+	if err != nil {
+		c.check(fmt.Errorf("failed to look up channel to invalidate: %w", err))
+		return
+	}
+
+	c.invalidate(ctx, cachedChannelKey(message.ChannelID))
+}
+
+func (c *CachedRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
+	return c.Source.FindAll(ctx, page)
+}
+
+func (c *CachedRepo) FindByChannelID(ctx context.Context, channelID uuid.UUID, page FindAllPage) (FindResult, error) {
+	if page.Cursor != nil {
+		return c.Source.FindByChannelID(ctx, channelID, page)
+	}
+
+	key := cachedChannelKey(channelID)
+	field := strconv.FormatUint(page.Size, 10)
+
+	var res FindResult
+	if c.get(ctx, c.Client.HGet(ctx, key, field), &res) {
+		return res, nil
+	}
+
+	generation, fill := c.generation(ctx, key)
+
+	res, err := c.Source.FindByChannelID(ctx, channelID, page)
+	if err != nil {
+		return FindResult{}, err
+	}
+
+	if data, ok := c.encode(res); ok && fill {
+		keys := []string{key, cachedGenerationKey(key)}
+		c.check(fillPageScript.Run(ctx, c.Client, keys, generation, data, c.TTL.Milliseconds(), field).Err())
+	}
+
+	return res, nil
+}
+
+func (c *CachedRepo) FindByParentID(ctx context.Context, parentID uuid.UUID, page FindAllPage) (FindResult, error) {
+	return c.Source.FindByParentID(ctx, parentID, page)
+}
+
+// get decodes a cached value into v and reports whether it was a hit.
+func (c *CachedRepo) get(ctx context.Context, cmd *redis.StringCmd, v any) bool {
+	data, err := cmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.misses.Add(1)
+		return false
+	} else if err != nil {
+		c.check(err)
+		c.misses.Add(1)
+		return false
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		c.check(fmt.Errorf("failed to decode cached value: %w", err))
+		c.misses.Add(1)
+		return false
+	}
+
+	c.hits.Add(1)
+	return true
+}
+
+func (c *CachedRepo) encode(v any) ([]byte, bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.check(fmt.Errorf("failed to encode cached value: %w", err))
+		return nil, false
+	}
+	return data, true
+}
+
+// generation reads the current generation of a cached key, empty if it was
+// never dropped, and reports whether a fill may go ahead.
+func (c *CachedRepo) generation(ctx context.Context, key string) (string, bool) {
+	generation, err := c.Client.Get(ctx, cachedGenerationKey(key)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", true
+	} else if err != nil {
+		c.check(err)
+		return "", false
+	}
+	return generation, true
+}
+
+func (c *CachedRepo) invalidate(ctx context.Context, keys ...string) {
+	scriptKeys := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		scriptKeys = append(scriptKeys, key, cachedGenerationKey(key))
+	}
+	c.check(invalidateScript.Run(ctx, c.Client, scriptKeys, generationTTL.Milliseconds()).Err())
+}
+
+func (c *CachedRepo) check(err error) {
+	if err != nil {
+		c.errors.Add(1)
+		log.Printf("message cache: %v", err)
+	}
+}
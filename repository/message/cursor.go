@@ -0,0 +1,56 @@
+package message
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+type Direction uint8
+
+const (
+	Forward Direction = iota
+	Backward
+)
+
+// Cursor is a keyset position in a listing. Rows are keyed by
+// (created_at, message_id); a forward read returns the rows that follow the
+// position in the listing's order and a backward read the rows that precede it.
+type Cursor struct {
+	CreatedAt time.Time
+	MessageID uuid.UUID
+	Direction Direction
+}
+
+func cursorOf(message model.Message, direction Direction) *Cursor {
+	var createdAt time.Time
+	if message.CreatedAt != nil {
+		createdAt = *message.CreatedAt
+	}
+
+	return &Cursor{
+		CreatedAt: createdAt.UTC().Truncate(time.Microsecond),
+		MessageID: message.MessageID,
+		Direction: direction,
+	}
+}
+
+// after reports whether m sorts strictly after the cursor position.
+func (c Cursor) after(m model.Message) bool {
+	var createdAt time.Time
+	if m.CreatedAt != nil {
+		createdAt = m.CreatedAt.Truncate(time.Microsecond)
+	}
+
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.After(c.CreatedAt)
+	}
+	return m.MessageID.String() > c.MessageID.String()
+}
+
+// before reports whether m sorts strictly before the cursor position.
+func (c Cursor) before(m model.Message) bool {
+	return m.MessageID != c.MessageID && !c.after(m)
+}
@@ -0,0 +1,199 @@
+package message
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// ErrEventsTrimmed means events after the requested position have already
+// been trimmed from the log, so reading from there would leave a gap.
+var ErrEventsTrimmed = errors.New("events have been trimmed from the log")
+
+const (
+	defaultEventLogLength = 1000
+
+	// eventLoggedTTL is how long an appended event is remembered, so a
+	// relay retrying the same event does not log it twice.
+	eventLoggedTTL = 24 * time.Hour
+)
+
+// EventLog is a bounded, ordered log of each channel's events, shared by the
+// real-time transports and clients catching up. Positions are stream IDs,
+// which only ever grow within a channel. RedisRepo satisfies it and logs its
+// own mutations to it.
+type EventLog interface {
+	// AppendEvent logs event and returns its position. Appending an event
+	// that was already logged returns the position it got the first time.
+	AppendEvent(ctx context.Context, event model.Event) (string, error)
+	// EventsSince returns up to limit events of the channel logged after
+	// position after, oldest first, with StreamID set. It fails with
+	// ErrEventsTrimmed if some of them may no longer be in the log. After
+	// "0" reads from the oldest event kept.
+	EventsSince(ctx context.Context, channelID uuid.UUID, after string, limit int64) ([]model.Event, error)
+	// LastEventID returns the position of the channel's newest event, or
+	// "0" if it has none.
+	LastEventID(ctx context.Context, channelID uuid.UUID) (string, error)
+}
+
+var _ EventLog = (*RedisRepo)(nil)
+
+func eventStreamKey(channelID uuid.UUID) string {
+	return fmt.Sprintf("channel:%s:events", channelID.String())
+}
+
+func eventLoggedKey(eventID uuid.UUID) string {
+	return fmt.Sprintf("event:%s:logged", eventID.String())
+}
+
+// appendEventScript adds an event to a channel stream unless the event ID
+// was logged before, atomically.
+var appendEventScript = redis.NewScript(`
+local id = redis.call('GET', KEYS[2])
+if id then
+	return id
+end
+id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[1], '*', 'event', ARGV[2])
+redis.call('SET', KEYS[2], id, 'PX', ARGV[3])
+return id
+`)
+
+func (r *RedisRepo) eventLogLength() int64 {
+	if r.EventLogLength > 0 {
+		return r.EventLogLength
+	}
+	return defaultEventLogLength
+}
+
+func (r *RedisRepo) AppendEvent(ctx context.Context, event model.Event) (string, error) {
+	keys, args, err := r.appendEventArgs(event)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := appendEventScript.Run(ctx, r.Client, keys, args...).Text()
+	if err != nil {
+		return "", fmt.Errorf("failed to append event: %w", err)
+	}
+	return id, nil
+}
+
+// logEvent queues the append of event to its channel's log on pipe, so a
+// mutation and its event are committed in the same MULTI.
+func (r *RedisRepo) logEvent(ctx context.Context, pipe redis.Pipeliner, event model.Event) error {
+	keys, args, err := r.appendEventArgs(event)
+	if err != nil {
+		return err
+	}
+
+	// EVALSHA cannot fall back to EVAL inside a transaction, so the script
+	// is sent in full.
+	appendEventScript.Eval(ctx, pipe, keys, args...)
+	return nil
+}
+
+func (r *RedisRepo) appendEventArgs(event model.Event) ([]string, []any, error) {
+	event.StreamID = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	keys := []string{eventStreamKey(event.ChannelID), eventLoggedKey(event.EventID)}
+	args := []any{r.eventLogLength(), data, eventLoggedTTL.Milliseconds()}
+	return keys, args, nil
+}
+
+func (r *RedisRepo) EventsSince(ctx context.Context, channelID uuid.UUID, after string, limit int64) ([]model.Event, error) {
+	key := eventStreamKey(channelID)
+
+	// The log is trimmed from the front, so anything between after and the
+	// oldest entry still kept is gone. The entry at after itself may have
+	// been the last one trimmed, in which case nothing was missed, but there
+	// is no telling that apart.
+	oldest, err := r.Client.XRangeN(ctx, key, "-", "+", 1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %w", err)
+	}
+	if len(oldest) > 0 && after != "0" && CompareStreamIDs(oldest[0].ID, after) > 0 {
+		return nil, ErrEventsTrimmed
+	}
+
+	entries, err := r.Client.XRangeN(ctx, key, "("+after, "+", limit).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %w", err)
+	}
+
+	events := make([]model.Event, 0, len(entries))
+	for _, entry := range entries {
+		data, ok := entry.Values["event"].(string)
+		if !ok {
+			return nil, fmt.Errorf("event log entry %s has no event", entry.ID)
+		}
+
+		var event model.Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode event %s: %w", entry.ID, err)
+		}
+		event.StreamID = entry.ID
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func (r *RedisRepo) LastEventID(ctx context.Context, channelID uuid.UUID) (string, error) {
+	entries, err := r.Client.XRevRangeN(ctx, eventStreamKey(channelID), "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to read event log: %w", err)
+	}
+	if len(entries) == 0 {
+		return "0", nil
+	}
+	return entries[0].ID, nil
+}
+
+// CompareStreamIDs orders two stream IDs, <milliseconds>-<sequence>, like
+// strings.Compare.
+func CompareStreamIDs(a, b string) int {
+	am, as, _ := parseStreamID(a)
+	bm, bs, _ := parseStreamID(b)
+
+	if am != bm {
+		return cmp.Compare(am, bm)
+	}
+	return cmp.Compare(as, bs)
+}
+
+// ValidStreamID reports whether id is a complete stream ID.
+func ValidStreamID(id string) bool {
+	_, _, ok := parseStreamID(id)
+	return ok
+}
+
+func parseStreamID(id string) (ms, seq uint64, ok bool) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
@@ -0,0 +1,96 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotencyLockTTL bounds how long a claimed key stays pending, so a
+// request that dies half way does not block retries for the full TTL.
+const idempotencyLockTTL = time.Minute
+
+// IdempotentResponse is the answer to a request made with an idempotency
+// key, kept so a retry with the same key gets the same answer. Fingerprint
+// identifies the request body the key was first used with.
+type IdempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Pending     bool   `json:"pending,omitempty"`
+	Status      int    `json:"status,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// IdempotencyStore remembers responses by idempotency key. RedisRepo
+// satisfies it.
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey marks key as pending for the request with the
+	// given fingerprint. If the key is already known it reports false along
+	// with what was stored for it.
+	ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (IdempotentResponse, bool, error)
+	// SaveIdempotentResponse replaces the pending claim with the response
+	// and keeps it for ttl.
+	SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error
+	// ReleaseIdempotencyKey drops a claim whose request failed, so it can be
+	// retried.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
+
+var _ IdempotencyStore = (*RedisRepo)(nil)
+
+func idempotencyKey(key string) string {
+	return fmt.Sprintf("idempotency:%s", key)
+}
+
+func (r *RedisRepo) ClaimIdempotencyKey(ctx context.Context, key, fingerprint string) (IdempotentResponse, bool, error) {
+	data, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint, Pending: true})
+	if err != nil {
+		return IdempotentResponse{}, false, fmt.Errorf("failed to encode idempotency claim: %w", err)
+	}
+
+	// The stored entry can expire between SETNX and GET; claim again then.
+	for {
+		claimed, err := r.Client.SetNX(ctx, idempotencyKey(key), data, idempotencyLockTTL).Result()
+		if err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+		} else if claimed {
+			return IdempotentResponse{}, true, nil
+		}
+
+		value, err := r.Client.Get(ctx, idempotencyKey(key)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("failed to get idempotency key: %w", err)
+		}
+
+		var response IdempotentResponse
+		if err := json.Unmarshal(value, &response); err != nil {
+			return IdempotentResponse{}, false, fmt.Errorf("failed to decode idempotent response: %w", err)
+		}
+		return response, false, nil
+	}
+}
+
+func (r *RedisRepo) SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotent response: %w", err)
+	}
+
+	if err := r.Client.Set(ctx, idempotencyKey(key), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisRepo) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	if err := r.Client.Del(ctx, idempotencyKey(key)).Err(); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
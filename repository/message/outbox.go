@@ -0,0 +1,119 @@
+package message
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/uptrace/bun"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+const maxOutboxBackoff = 5 * time.Minute
+
+// enqueue records an event in the outbox as part of tx, so it is stored if
+// and only if the change it describes is.
+func enqueue(ctx context.Context, tx bun.Tx, event model.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	_, err = tx.NewInsert().Model(&model.OutboxEvent{
+		RoutingKey: event.RoutingKey(),
+		Payload:    payload,
+	}).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return nil
+}
+
+// RelayOutbox hands up to limit due outbox events to publish, oldest first,
+// and marks each one sent or schedules a retry with exponential backoff. An
+// event that has failed maxAttempts times is marked dead and no longer
+// retried. Claimed rows stay locked until the batch is done and other relays
+// skip them, so replicas can run the relay side by side. Delivery is at
+// least once: a crash after publishing but before commit re-sends the batch.
+func (p *PostgresRepo) RelayOutbox(ctx context.Context, limit, maxAttempts int, publish func(ctx context.Context, event model.OutboxEvent) error) (int, error) {
+	sent := 0
+
+	err := p.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var events []model.OutboxEvent
+		err := tx.NewSelect().
+			Model(&events).
+			Where("sent_at IS NULL").
+			Where("dead_at IS NULL").
+			Where("next_attempt_at <= ?", time.Now().UTC()).
+			Order("id ASC").
+			Limit(limit).
+			For("UPDATE SKIP LOCKED").
+			Scan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to claim outbox events: %w", err)
+		}
+
+		for _, event := range events {
+			now := time.Now().UTC()
+
+			query := tx.NewUpdate().
+				Model((*model.OutboxEvent)(nil)).
+				Where("id = ?", event.ID)
+
+			if err := publish(ctx, event); err != nil {
+				query.
+					Set("attempts = attempts + 1").
+					Set("last_error = ?", err.Error()).
+					Set("next_attempt_at = ?", now.Add(outboxBackoff(event.Attempts+1)))
+
+				if event.Attempts+1 >= maxAttempts {
+					query.Set("dead_at = ?", now)
+					log.Printf("outbox: giving up on event %d after %d attempts: %v", event.ID, event.Attempts+1, err)
+				}
+			} else {
+				query.Set("sent_at = ?", now)
+				sent++
+			}
+
+			if _, err := query.Exec(ctx); err != nil {
+				return fmt.Errorf("failed to update outbox event %d: %w", event.ID, err)
+			}
+		}
+
+		return nil
+	})
+
+	return sent, err
+}
+
+// PruneOutbox deletes events that were sent, or given up on, before the
+// cutoff.
+func (p *PostgresRepo) PruneOutbox(ctx context.Context, before time.Time) (int64, error) {
+	res, err := p.DB.NewDelete().
+		Model((*model.OutboxEvent)(nil)).
+		Where("sent_at < ? OR dead_at < ?", before, before).
+		Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune outbox: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	return n, nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return maxOutboxBackoff
+	}
+	backoff := time.Second << attempts
+	if backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
@@ -2,11 +2,15 @@ package message
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/CatalinPlesu/message-service/model"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
 )
 
 type PostgresRepo struct {
@@ -17,126 +21,306 @@ func NewPostgresRepo(db *bun.DB) *PostgresRepo {
 	return &PostgresRepo{DB: db}
 }
 
-func (p *PostgresRepo) Migrate(ctx context.Context) error {
-	_, err := p.DB.NewCreateTable().
-		Model((*model.Message)(nil)).
-		IfNotExists().
-		Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create messages table: %w", err)
-	}
-	return nil
-}
-
+// Insert stores the message and records a created event in the same
+// transaction.
 func (p *PostgresRepo) Insert(ctx context.Context, message model.Message) error {
-	_, err := p.DB.NewInsert().Model(&message).Exec(ctx)
-	if err != nil {
-		p.Migrate(ctx)
-		return fmt.Errorf("failed to insert message: %w", err)
-	}
-	return nil
+	return p.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&message).Exec(ctx)
+		if isForeignKeyViolation(err) {
+			return ErrParentNotExist
+		} else if isUniqueViolation(err) {
+			return ErrAlreadyExists
+		} else if err != nil {
+			return fmt.Errorf("failed to insert message: %w", err)
+		}
+
+		return enqueue(ctx, tx, model.NewEvent(model.MessageCreated, message, time.Now()))
+	})
 }
 
-func (p *PostgresRepo) FindByID(ctx context.Context, id uuid.UUID) (*model.Message, error) {
+func (p *PostgresRepo) FindByID(ctx context.Context, id uuid.UUID) (model.Message, error) {
 	var message model.Message
 	err := p.DB.NewSelect().Model(&message).Where("message_id = ?", id).Scan(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find message by ID: %w", err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Message{}, ErrNotExist
+	} else if err != nil {
+		return model.Message{}, fmt.Errorf("failed to find message by ID: %w", err)
 	}
-	return &message, nil
+	return message, nil
+}
+
+// DeleteByID tombstones the message and records a deleted event.
+func (p *PostgresRepo) DeleteByID(ctx context.Context, id uuid.UUID, deletedBy *uuid.UUID, version int64) error {
+	return p.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		now := time.Now().UTC()
+
+		var message model.Message
+		res, err := tx.NewUpdate().
+			Model(&message).
+			Set("deleted_at = ?", now).
+			Set("deleted_by = ?", deletedBy).
+			Set("version = version + 1").
+			Where("message_id = ?", id).
+			Where("deleted_at IS NULL").
+			Where("version = ?", version).
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete message: %w", err)
+		}
+		if err := checkVersioned(ctx, tx, res, id); err != nil {
+			return err
+		}
+
+		return enqueue(ctx, tx, model.NewEvent(model.MessageDeleted, message, now))
+	})
 }
 
-func (p *PostgresRepo) DeleteByID(ctx context.Context, id uuid.UUID) error {
-	_, err := p.DB.NewDelete().Model((*model.Message)(nil)).Where("message_id = ?", id).Exec(ctx)
+// Restore clears the tombstone and records a restored event.
+func (p *PostgresRepo) Restore(ctx context.Context, id uuid.UUID) error {
+	return p.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var message model.Message
+		res, err := tx.NewUpdate().
+			Model(&message).
+			Set("deleted_at = NULL").
+			Set("deleted_by = NULL").
+			Set("version = version + 1").
+			Where("message_id = ?", id).
+			Where("deleted_at IS NOT NULL").
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to restore message: %w", err)
+		}
+		if err := checkAffected(res); err != nil {
+			return err
+		}
+
+		return enqueue(ctx, tx, model.NewEvent(model.MessageRestored, message, time.Now()))
+	})
+}
+
+// Purge hard-deletes tombstones deleted before the cutoff. A tombstone that
+// still has replies is kept so the thread stays intact; once its replies are
+// purged it goes on a later run.
+func (p *PostgresRepo) Purge(ctx context.Context, before time.Time) (int64, error) {
+	res, err := p.DB.NewDelete().
+		Model((*model.Message)(nil)).
+		Where("deleted_at < ?", before).
+		Where("NOT EXISTS (SELECT 1 FROM messages AS reply WHERE reply.parent_id = message.message_id)").
+		Exec(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to delete message: %w", err)
+		return 0, fmt.Errorf("failed to purge deleted messages: %w", err)
 	}
-	return nil
-}
 
-func (p *PostgresRepo) Update(ctx context.Context, message *model.Message) error {
-	_, err := p.DB.NewUpdate().Model(message).Where("message_id = ?", message.MessageID).Exec(ctx)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to update message: %w", err)
+		return 0, fmt.Errorf("failed to read affected rows: %w", err)
 	}
-	return nil
+	return n, nil
 }
 
-type MessagePage struct {
-	Messages []model.Message
-	Cursor   uint64
-}
+// Update writes the new text and, if it differs from the stored one, saves
+// the old text as the next revision. message.Version must match the stored
+// version or ErrVersionConflict is returned. The row is locked for the
+// duration so concurrent edits get consecutive revision numbers. An updated
+// event is recorded alongside.
+func (p *PostgresRepo) Update(ctx context.Context, message model.Message, editedBy *uuid.UUID) error {
+	return p.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var current model.Message
+		err := tx.NewSelect().
+			Model(&current).
+			Column("message_text", "edited", "version").
+			Where("message_id = ?", message.MessageID).
+			Where("deleted_at IS NULL").
+			For("UPDATE").
+			Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to lock message: %w", err)
+		}
+		if current.Version != message.Version {
+			return ErrVersionConflict
+		}
 
-func (r *PostgresRepo) FindAll(ctx context.Context, page FindAllPage) (MessagePage, error) {
-	var messages []model.Message
+		message.Edited = current.Edited
+		if current.MessageText != message.MessageText {
+			message.Edited = true
 
-	query := r.DB.NewSelect().
-		Model(&messages).
-		Order("message_id ASC").
-		Limit(int(page.Size))
+			var revision int
+			err := tx.NewSelect().
+				Model((*model.MessageRevision)(nil)).
+				ColumnExpr("COALESCE(MAX(revision), 0) + 1").
+				Where("message_id = ?", message.MessageID).
+				Scan(ctx, &revision)
+			if err != nil {
+				return fmt.Errorf("failed to number revision: %w", err)
+			}
 
-	if page.Offset > 0 {
-		query.Where("message_id > ?", page.Offset)
-	}
+			editedAt := time.Now().UTC()
+			if message.UpdatedAt != nil {
+				editedAt = *message.UpdatedAt
+			}
+
+			_, err = tx.NewInsert().Model(&model.MessageRevision{
+				MessageID:   message.MessageID,
+				Revision:    revision,
+				MessageText: current.MessageText,
+				EditedBy:    editedBy,
+				EditedAt:    editedAt,
+			}).Exec(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to save revision: %w", err)
+			}
+		}
+
+		var updated model.Message
+		res, err := tx.NewUpdate().
+			Model(&updated).
+			Set("message_text = ?", message.MessageText).
+			Set("updated_at = ?", message.UpdatedAt).
+			Set("edited = ?", message.Edited).
+			Set("version = version + 1").
+			Where("message_id = ?", message.MessageID).
+			Where("version = ?", message.Version).
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to update message: %w", err)
+		}
+		if err := checkVersioned(ctx, tx, res, message.MessageID); err != nil {
+			return err
+		}
+
+		return enqueue(ctx, tx, model.NewEvent(model.MessageUpdated, updated, time.Now()))
+	})
+}
 
-	err := query.Scan(ctx)
+func (p *PostgresRepo) Revisions(ctx context.Context, id uuid.UUID) ([]model.MessageRevision, error) {
+	revisions := []model.MessageRevision{}
+	err := p.DB.NewSelect().
+		Model(&revisions).
+		Where("message_id = ?", id).
+		Order("revision ASC").
+		Scan(ctx)
 	if err != nil {
-		return MessagePage{}, fmt.Errorf("failed to retrieve messages: %w", err)
+		return nil, fmt.Errorf("failed to retrieve revisions: %w", err)
 	}
+	return revisions, nil
+}
 
-	if len(messages) == 0 {
-		return MessagePage{
-			Messages: []model.Message{},
-			Cursor:   0,
-		}, nil
-	}
+// isForeignKeyViolation reports whether err is the parent_id constraint
+// rejecting an insert whose parent does not exist.
+func isForeignKeyViolation(err error) bool {
+	var pgErr pgdriver.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == "23503"
+}
 
-	return MessagePage{
-		Messages: messages,
-		Cursor:   page.Size + 100,
-	}, nil
+// isUniqueViolation reports whether err is the primary key rejecting an
+// insert whose message ID is taken.
+func isUniqueViolation(err error) bool {
+	var pgErr pgdriver.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == "23505"
 }
 
-func (p *PostgresRepo) FindByChannelID(ctx context.Context, channelID uuid.UUID, page FindAllPage) ([]model.Message, uint64, error) {
-	var messages []model.Message
+// checkVersioned tells apart the two reasons a conditional write can match no
+// rows: the message is gone, or its version moved on.
+func checkVersioned(ctx context.Context, db bun.IDB, res sql.Result, id uuid.UUID) error {
+	err := checkAffected(res)
+	if !errors.Is(err, ErrNotExist) {
+		return err
+	}
 
-	query := p.DB.NewSelect().
-		Model(&messages).
-		Where("channel_id = ?", channelID). 
-		Order("created_at ASC").           
-		Limit(int(page.Size))               
+	exists, err := db.NewSelect().
+		Model((*model.Message)(nil)).
+		Where("message_id = ?", id).
+		Where("deleted_at IS NULL").
+		Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check message: %w", err)
+	}
+	if exists {
+		return ErrVersionConflict
+	}
+	return ErrNotExist
+}
 
-	err := query.Scan(ctx)
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to retrieve messages: %w", err)
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return ErrNotExist
 	}
+	return nil
+}
 
-	var newCursor uint64
-	if len(messages) > 0 {
-		newCursor = page.Size + 100
+func (p *PostgresRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
+	res, err := p.findPage(ctx, page, false, nil)
+	if err != nil {
+		return FindResult{}, fmt.Errorf("failed to retrieve messages: %w", err)
+	}
+	return res, nil
+}
+
+func (p *PostgresRepo) FindByChannelID(ctx context.Context, channelID uuid.UUID, page FindAllPage) (FindResult, error) {
+	res, err := p.findPage(ctx, page, false, func(q *bun.SelectQuery) *bun.SelectQuery {
+		return q.Where("channel_id = ?", channelID)
+	})
+	if err != nil {
+		return FindResult{}, fmt.Errorf("failed to retrieve messages: %w", err)
 	}
+	return res, nil
+}
 
-	return messages, newCursor, nil
+func (p *PostgresRepo) FindByParentID(ctx context.Context, parentID uuid.UUID, page FindAllPage) (FindResult, error) {
+	res, err := p.findPage(ctx, page, true, func(q *bun.SelectQuery) *bun.SelectQuery {
+		return q.Where("parent_id = ?", parentID)
+	})
+	if err != nil {
+		return FindResult{}, fmt.Errorf("failed to retrieve child messages: %w", err)
+	}
+	return res, nil
 }
 
-func (p *PostgresRepo) FindByParentID(ctx context.Context, parentID uuid.UUID, page FindAllPage) ([]model.Message, uint64, error) {
+// findPage runs a keyset-paginated listing ordered by (created_at, message_id),
+// ascending unless desc is set. One extra row is read to learn whether another
+// page follows.
+func (p *PostgresRepo) findPage(ctx context.Context, page FindAllPage, desc bool, filter func(*bun.SelectQuery) *bun.SelectQuery) (FindResult, error) {
 	var messages []model.Message
 
+	backward := page.Cursor != nil && page.Cursor.Direction == Backward
+	asc := desc == backward
+
+	order, op := "ASC", ">"
+	if !asc {
+		order, op = "DESC", "<"
+	}
+
 	query := p.DB.NewSelect().
 		Model(&messages).
-		Where("parent_id = ?", parentID).
-		Order("created_at DESC").
-		Limit(int(page.Size))
+		Apply(filter).
+		OrderExpr("created_at " + order).
+		OrderExpr("message_id " + order).
+		Limit(int(page.Size) + 1)
 
-	err := query.Scan(ctx)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to retrieve child messages: %w", err)
+	if page.Cursor != nil {
+		query.Where("(created_at, message_id) "+op+" (?, ?)", page.Cursor.CreatedAt, page.Cursor.MessageID)
 	}
 
-	var newCursor uint64
-	if len(messages) > 0 {
-		newCursor = page.Size + 100
+	if err := query.Scan(ctx); err != nil {
+		return FindResult{}, err
+	}
+
+	hasMore := uint64(len(messages)) > page.Size
+	if hasMore {
+		messages = messages[:page.Size]
+	}
+	if backward {
+		reverse(messages)
 	}
 
-	return messages, newCursor, nil
+	return pageResult(messages, page, hasMore), nil
 }
@@ -0,0 +1,221 @@
+package message
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+// PresenceStore keeps users' ephemeral activity in channels. Nothing in it
+// outlives its TTL, and it never reaches Postgres.
+type PresenceStore interface {
+	// Signal marks the user active for ttl and reports whether they were
+	// not already.
+	Signal(ctx context.Context, kind model.PresenceKind, channelID, userID uuid.UUID, ttl time.Duration) (model.Presence, bool, error)
+	// Clear ends the user's activity and reports whether there was any.
+	Clear(ctx context.Context, kind model.PresenceKind, channelID, userID uuid.UUID) (bool, error)
+	// Active lists the users currently active in the channel.
+	Active(ctx context.Context, kind model.PresenceKind, channelID uuid.UUID) ([]model.Presence, error)
+	// Expired claims up to limit activities that ran out without being
+	// cleared. Each is handed to exactly one caller, whichever replica it
+	// runs on.
+	Expired(ctx context.Context, limit int64) ([]model.Presence, error)
+}
+
+var _ PresenceStore = (*PresenceRepo)(nil)
+
+// PresenceRepo stores each activity as a key that expires with it. Sorted
+// sets scored by expiry, one per channel and kind plus one across all of
+// them, make the activities listable and let expiry be noticed.
+type PresenceRepo struct {
+	Client *redis.Client
+}
+
+const presenceExpiriesKey = "presence:expiries"
+
+func presenceKey(kind model.PresenceKind, channelID, userID uuid.UUID) string {
+	return fmt.Sprintf("channel:%s:%s:%s", channelID.String(), kind, userID.String())
+}
+
+func presenceSetKey(kind model.PresenceKind, channelID uuid.UUID) string {
+	return fmt.Sprintf("channel:%s:%s", channelID.String(), kind)
+}
+
+// presenceMember names an activity in presenceExpiriesKey.
+func presenceMember(kind model.PresenceKind, channelID, userID uuid.UUID) string {
+	return fmt.Sprintf("%s:%s:%s", kind, channelID.String(), userID.String())
+}
+
+func parsePresenceMember(member string, expiresAt time.Time) (model.Presence, error) {
+	parts := strings.Split(member, ":")
+	if len(parts) != 3 {
+		return model.Presence{}, fmt.Errorf("invalid presence %q", member)
+	}
+
+	channelID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return model.Presence{}, fmt.Errorf("invalid presence %q: %w", member, err)
+	}
+	userID, err := uuid.Parse(parts[2])
+	if err != nil {
+		return model.Presence{}, fmt.Errorf("invalid presence %q: %w", member, err)
+	}
+
+	return model.Presence{
+		Kind:      model.PresenceKind(parts[0]),
+		ChannelID: channelID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+var (
+	signalPresenceScript = redis.NewScript(`
+local existed = redis.call('EXISTS', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[1], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[1], ARGV[4])
+return existed
+`)
+
+	clearPresenceScript = redis.NewScript(`
+local existed = redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[2])
+return existed
+`)
+
+	// claimExpiredScript takes expired activities off the expiry set in one
+	// step, so two sweepers never report the same one.
+	claimExpiredScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, ARGV[2])
+for i = 1, #expired, 2 do
+	redis.call('ZREM', KEYS[1], expired[i])
+end
+return expired
+`)
+)
+
+func (r *PresenceRepo) Signal(ctx context.Context, kind model.PresenceKind, channelID, userID uuid.UUID, ttl time.Duration) (model.Presence, bool, error) {
+	presence := model.Presence{
+		Kind:      kind,
+		ChannelID: channelID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(ttl).UTC().Truncate(time.Millisecond),
+	}
+
+	keys := []string{
+		presenceKey(kind, channelID, userID),
+		presenceSetKey(kind, channelID),
+		presenceExpiriesKey,
+	}
+	args := []any{
+		presence.ExpiresAt.UnixMilli(),
+		ttl.Milliseconds(),
+		userID.String(),
+		presenceMember(kind, channelID, userID),
+	}
+
+	existed, err := signalPresenceScript.Run(ctx, r.Client, keys, args...).Int()
+	if err != nil {
+		return model.Presence{}, false, fmt.Errorf("failed to signal presence: %w", err)
+	}
+
+	return presence, existed == 0, nil
+}
+
+func (r *PresenceRepo) Clear(ctx context.Context, kind model.PresenceKind, channelID, userID uuid.UUID) (bool, error) {
+	keys := []string{
+		presenceKey(kind, channelID, userID),
+		presenceSetKey(kind, channelID),
+		presenceExpiriesKey,
+	}
+	args := []any{
+		userID.String(),
+		presenceMember(kind, channelID, userID),
+	}
+
+	existed, err := clearPresenceScript.Run(ctx, r.Client, keys, args...).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to clear presence: %w", err)
+	}
+
+	return existed > 0, nil
+}
+
+func (r *PresenceRepo) Active(ctx context.Context, kind model.PresenceKind, channelID uuid.UUID) ([]model.Presence, error) {
+	key := presenceSetKey(kind, channelID)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	// Expired members linger until the sweeper gets to them; skip them.
+	members, err := r.Client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: "(" + now,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list presence: %w", err)
+	}
+
+	active := make([]model.Presence, 0, len(members))
+	for _, member := range members {
+		userID, err := uuid.Parse(fmt.Sprint(member.Member))
+		if err != nil {
+			return nil, fmt.Errorf("invalid presence member %v: %w", member.Member, err)
+		}
+
+		active = append(active, model.Presence{
+			Kind:      kind,
+			ChannelID: channelID,
+			UserID:    userID,
+			ExpiresAt: time.UnixMilli(int64(member.Score)).UTC(),
+		})
+	}
+
+	return active, nil
+}
+
+func (r *PresenceRepo) Expired(ctx context.Context, limit int64) ([]model.Presence, error) {
+	now := time.Now().UnixMilli()
+
+	values, err := claimExpiredScript.Run(ctx, r.Client, []string{presenceExpiriesKey}, now, limit).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim expired presence: %w", err)
+	}
+
+	expired := make([]model.Presence, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseInt(values[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid presence expiry %q: %w", values[i+1], err)
+		}
+
+		presence, err := parsePresenceMember(values[i], time.UnixMilli(score).UTC())
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, presence)
+	}
+
+	// The per-channel sets are already filtered by score when read; this
+	// just keeps them from growing. Going by score rather than member keeps
+	// anyone who signalled again since.
+	if len(expired) > 0 {
+		until := strconv.FormatInt(now, 10)
+		pipe := r.Client.Pipeline()
+		for _, p := range expired {
+			pipe.ZRemRangeByScore(ctx, presenceSetKey(p.Kind, p.ChannelID), "-inf", until)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to prune presence: %w", err)
+		}
+	}
+
+	return expired, nil
+}
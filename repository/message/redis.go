@@ -5,21 +5,49 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 
 	"github.com/CatalinPlesu/message-service/model"
 )
 
+// RedisRepo stores messages as JSON blobs indexed by sorted sets. Every
+// mutation also appends its event to the channel's event log, in the same
+// transaction.
 type RedisRepo struct {
 	Client *redis.Client
+	// EventLogLength is roughly how many events each channel's event log
+	// keeps; 1000 when zero.
+	EventLogLength int64
 }
 
 func messageIDKey(id uuid.UUID) string {
 	return fmt.Sprintf("message:%s", id.String())
 }
 
+func revisionsKey(id uuid.UUID) string {
+	return fmt.Sprintf("message:%s:revisions", id.String())
+}
+
+func channelSetKey(id uuid.UUID) string {
+	return fmt.Sprintf("channel:%s:messages", id.String())
+}
+
+func parentSetKey(id uuid.UUID) string {
+	return fmt.Sprintf("parent:%s:messages", id.String())
+}
+
+// score orders the sorted-set indexes by creation time in microseconds, which
+// a float64 holds exactly. Ties are broken by member, i.e. by message ID.
+func score(message model.Message) float64 {
+	if message.CreatedAt == nil {
+		return 0
+	}
+	return float64(message.CreatedAt.UnixMicro())
+}
+
 func (r *RedisRepo) Insert(ctx context.Context, message model.Message) error {
 	data, err := json.Marshal(message)
 	if err != nil {
@@ -28,28 +56,39 @@ func (r *RedisRepo) Insert(ctx context.Context, message model.Message) error {
 
 	key := messageIDKey(message.MessageID)
 
-	txn := r.Client.TxPipeline()
-
-	res := txn.SetNX(ctx, key, string(data), 0)
-	if err := res.Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to set message: %w", err)
-	}
-
-	if err := txn.SAdd(ctx, "messages", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to add message to set: %w", err)
-	}
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check message: %w", err)
+		} else if n > 0 {
+			return ErrAlreadyExists
+		}
 
-	if _, err := txn.Exec(ctx); err != nil {
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			member := redis.Z{Score: score(message), Member: key}
+
+			pipe.Set(ctx, key, string(data), 0)
+			pipe.ZAdd(ctx, "messages", member)
+			pipe.ZAdd(ctx, channelSetKey(message.ChannelID), member)
+			if message.ParentID != nil {
+				pipe.ZAdd(ctx, parentSetKey(*message.ParentID), member)
+			}
+			return r.logEvent(ctx, pipe, model.NewEvent(model.MessageCreated, message, time.Now()))
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		// Someone wrote the key between the check and the transaction.
+		return ErrAlreadyExists
+	} else if errors.Is(err, ErrAlreadyExists) {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("failed to execute transaction: %w", err)
 	}
 
 	return nil
 }
 
-var ErrNotExist = errors.New("message does not exist")
-
 func (r *RedisRepo) FindByID(ctx context.Context, id uuid.UUID) (model.Message, error) {
 	key := messageIDKey(id)
 
@@ -69,43 +108,127 @@ func (r *RedisRepo) FindByID(ctx context.Context, id uuid.UUID) (model.Message,
 	return message, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uuid.UUID) error {
-	key := messageIDKey(id)
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uuid.UUID, deletedBy *uuid.UUID, version int64) error {
+	return r.modify(ctx, id, model.MessageDeleted, func(message *model.Message, _ redis.Pipeliner) error {
+		if message.DeletedAt != nil {
+			return ErrNotExist
+		}
+		if message.Version != version {
+			return ErrVersionConflict
+		}
 
-	txn := r.Client.TxPipeline()
+		now := time.Now().UTC()
+		message.DeletedAt = &now
+		message.DeletedBy = deletedBy
+		return nil
+	})
+}
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
-	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to delete message: %w", err)
-	}
+func (r *RedisRepo) Restore(ctx context.Context, id uuid.UUID) error {
+	return r.modify(ctx, id, model.MessageRestored, func(message *model.Message, _ redis.Pipeliner) error {
+		if message.DeletedAt == nil {
+			return ErrNotExist
+		}
 
-	if err := txn.SRem(ctx, "messages", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to remove message from set: %w", err)
-	}
+		message.DeletedAt = nil
+		message.DeletedBy = nil
+		return nil
+	})
+}
 
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("failed to execute transaction: %w", err)
-	}
+// Update saves the new text and appends the old one to the message's
+// revision list when it changed. Revision numbers are list positions, so
+// they are assigned by RPUSH rather than read-then-written.
+func (r *RedisRepo) Update(ctx context.Context, message model.Message, editedBy *uuid.UUID) error {
+	return r.modify(ctx, message.MessageID, model.MessageUpdated, func(current *model.Message, pipe redis.Pipeliner) error {
+		if current.DeletedAt != nil {
+			return ErrNotExist
+		}
+		if current.Version != message.Version {
+			return ErrVersionConflict
+		}
 
-	return nil
+		if current.MessageText != message.MessageText {
+			editedAt := time.Now().UTC()
+			if message.UpdatedAt != nil {
+				editedAt = *message.UpdatedAt
+			}
+
+			data, err := json.Marshal(model.MessageRevision{
+				MessageID:   message.MessageID,
+				MessageText: current.MessageText,
+				EditedBy:    editedBy,
+				EditedAt:    editedAt,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to encode revision: %w", err)
+			}
+
+			pipe.RPush(ctx, revisionsKey(message.MessageID), data)
+			current.MessageText = message.MessageText
+			current.Edited = true
+		}
+
+		current.UpdatedAt = message.UpdatedAt
+		return nil
+	})
 }
 
-func (r *RedisRepo) Update(ctx context.Context, message model.Message) error {
-	data, err := json.Marshal(message)
+func (r *RedisRepo) Revisions(ctx context.Context, id uuid.UUID) ([]model.MessageRevision, error) {
+	xs, err := r.Client.LRange(ctx, revisionsKey(id), 0, -1).Result()
 	if err != nil {
-		return fmt.Errorf("failed to encode message: %w", err)
+		return nil, fmt.Errorf("failed to get revisions: %w", err)
 	}
 
-	key := messageIDKey(message.MessageID)
+	revisions := make([]model.MessageRevision, len(xs))
+	for i, x := range xs {
+		if err := json.Unmarshal([]byte(x), &revisions[i]); err != nil {
+			return nil, fmt.Errorf("failed to decode revision json: %w", err)
+		}
+		revisions[i].Revision = i + 1
+	}
 
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
-	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
+	return revisions, nil
+}
+
+// modify applies fn to a stored message under WATCH and writes it back with
+// its version bumped, logging an event of eventType. fn may queue extra
+// writes on pipe; they are committed in the same MULTI. A concurrent write to
+// the message aborts the transaction and is reported as ErrVersionConflict.
+func (r *RedisRepo) modify(ctx context.Context, id uuid.UUID, eventType model.EventType, fn func(message *model.Message, pipe redis.Pipeliner) error) error {
+	key := messageIDKey(id)
+
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotExist
+		} else if err != nil {
+			return fmt.Errorf("failed to get message: %w", err)
+		}
+
+		var message model.Message
+		if err := json.Unmarshal([]byte(value), &message); err != nil {
+			return fmt.Errorf("failed to decode message json: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if err := fn(&message, pipe); err != nil {
+				return err
+			}
+			message.Version++
+
+			data, err := json.Marshal(message)
+			if err != nil {
+				return fmt.Errorf("failed to encode message: %w", err)
+			}
+
+			pipe.Set(ctx, key, string(data), 0)
+			return r.logEvent(ctx, pipe, model.NewEvent(eventType, message, time.Now()))
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionConflict
 	} else if err != nil {
 		return fmt.Errorf("failed to update message: %w", err)
 	}
@@ -113,51 +236,107 @@ func (r *RedisRepo) Update(ctx context.Context, message model.Message) error {
 	return nil
 }
 
-type FindAllPage struct {
-	Size   uint64
-	Offset uint64
+func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
+	return r.findPage(ctx, "messages", page, false)
 }
 
-type FindResult struct {
-	Messages  []model.Message
-	Cursor uint64
+func (r *RedisRepo) FindByChannelID(ctx context.Context, channelID uuid.UUID, page FindAllPage) (FindResult, error) {
+	return r.findPage(ctx, channelSetKey(channelID), page, false)
 }
 
-func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	res := r.Client.SScan(ctx, "messages", page.Offset, "*", int64(page.Size))
+func (r *RedisRepo) FindByParentID(ctx context.Context, parentID uuid.UUID, page FindAllPage) (FindResult, error) {
+	return r.findPage(ctx, parentSetKey(parentID), page, true)
+}
 
-	keys, cursor, err := res.Result()
-	if err != nil {
-		return FindResult{}, fmt.Errorf("failed to get message ids: %w", err)
+// findPage walks a sorted-set index from the cursor's score. Members sharing
+// the cursor's score are filtered in Go, so the range is read in batches until
+// a full page (plus one, to detect more) is collected.
+func (r *RedisRepo) findPage(ctx context.Context, set string, page FindAllPage, desc bool) (FindResult, error) {
+	backward := page.Cursor != nil && page.Cursor.Direction == Backward
+	asc := desc == backward
+	want := int64(page.Size) + 1
+
+	args := redis.ZRangeArgs{
+		Key:     set,
+		Start:   "-inf",
+		Stop:    "+inf",
+		ByScore: true,
+		Rev:     !asc,
+		Count:   want,
+	}
+	if page.Cursor != nil {
+		at := page.Cursor.CreatedAt.UnixMicro()
+		if asc {
+			args.Start = at
+		} else {
+			args.Stop = at
+		}
 	}
 
-	if len(keys) == 0 {
-		return FindResult{
-			Messages: []model.Message{},
-		}, nil
+	messages := []model.Message{}
+	for int64(len(messages)) < want {
+		keys, err := r.Client.ZRangeArgs(ctx, args).Result()
+		if err != nil {
+			return FindResult{}, fmt.Errorf("failed to get message ids: %w", err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		args.Offset += int64(len(keys))
+
+		batch, err := r.getAll(ctx, keys)
+		if err != nil {
+			return FindResult{}, err
+		}
+
+		for _, message := range batch {
+			if c := page.Cursor; c != nil {
+				if asc && !c.after(message) || !asc && !c.before(message) {
+					continue
+				}
+			}
+			messages = append(messages, message)
+		}
+
+		if int64(len(keys)) < want {
+			break
+		}
 	}
 
+	hasMore := uint64(len(messages)) > page.Size
+	if hasMore {
+		messages = messages[:page.Size]
+	}
+	if backward {
+		reverse(messages)
+	}
+
+	return pageResult(messages, page, hasMore), nil
+}
+
+func (r *RedisRepo) getAll(ctx context.Context, keys []string) ([]model.Message, error) {
 	xs, err := r.Client.MGet(ctx, keys...).Result()
 	if err != nil {
-		return FindResult{}, fmt.Errorf("failed to get messages: %w", err)
+		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
 
-	messages := make([]model.Message, len(xs))
+	messages := make([]model.Message, 0, len(xs))
 
-	for i, x := range xs {
-		x := x.(string)
-		var message model.Message
+	for _, x := range xs {
+		x, ok := x.(string)
+		if !ok {
+			// The key expired or was deleted after the index was read.
+			continue
+		}
 
+		var message model.Message
 		err := json.Unmarshal([]byte(x), &message)
 		if err != nil {
-			return FindResult{}, fmt.Errorf("failed to decode message json: %w", err)
+			return nil, fmt.Errorf("failed to decode message json: %w", err)
 		}
 
-		messages[i] = message
+		messages = append(messages, message)
 	}
 
-	return FindResult{
-		Messages: messages,
-		Cursor: cursor,
-	}, nil
+	return messages, nil
 }
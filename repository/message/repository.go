@@ -0,0 +1,110 @@
+package message
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+var (
+	ErrNotExist        = errors.New("message does not exist")
+	ErrAlreadyExists   = errors.New("message already exists")
+	ErrParentNotExist  = errors.New("parent message does not exist")
+	ErrVersionConflict = errors.New("message version has changed")
+)
+
+// Repository is the storage contract the handlers are written against.
+// PostgresRepo and RedisRepo both satisfy it.
+//
+// Insert fails with ErrAlreadyExists if a message with the same ID exists,
+// which lets callers that pick their own IDs retry safely.
+//
+// Update and DeleteByID are conditional on the caller's view of the message
+// version (message.Version and version respectively) and fail with
+// ErrVersionConflict if it is stale; every successful write bumps the version.
+//
+// Update records the replaced text as a new revision when MessageText
+// changes. DeleteByID is a soft delete: the message stays in listings as a
+// tombstone until Restore brings it back or a purge removes it for good.
+//
+// PostgresRepo records a model.Event in its outbox for every write.
+type Repository interface {
+	Insert(ctx context.Context, message model.Message) error
+	FindByID(ctx context.Context, id uuid.UUID) (model.Message, error)
+	Update(ctx context.Context, message model.Message, editedBy *uuid.UUID) error
+	Revisions(ctx context.Context, id uuid.UUID) ([]model.MessageRevision, error)
+	DeleteByID(ctx context.Context, id uuid.UUID, deletedBy *uuid.UUID, version int64) error
+	Restore(ctx context.Context, id uuid.UUID) error
+	FindAll(ctx context.Context, page FindAllPage) (FindResult, error)
+	FindByChannelID(ctx context.Context, channelID uuid.UUID, page FindAllPage) (FindResult, error)
+	FindByParentID(ctx context.Context, parentID uuid.UUID, page FindAllPage) (FindResult, error)
+}
+
+var (
+	_ Repository = (*PostgresRepo)(nil)
+	_ Repository = (*RedisRepo)(nil)
+)
+
+// FindAllPage selects a page of a listing. A nil Cursor reads the first page.
+type FindAllPage struct {
+	Size   uint64
+	Cursor *Cursor
+}
+
+// FindResult is one page of a listing. Next and Prev are nil when there is
+// nothing further in that direction.
+type FindResult struct {
+	Messages []model.Message
+	Next     *Cursor
+	Prev     *Cursor
+}
+
+func pageResult(messages []model.Message, page FindAllPage, hasMore bool) FindResult {
+	if messages == nil {
+		messages = []model.Message{}
+	}
+
+	res := FindResult{Messages: messages}
+	backward := page.Cursor != nil && page.Cursor.Direction == Backward
+
+	if len(messages) == 0 {
+		if page.Cursor != nil {
+			turn := *page.Cursor
+			if backward {
+				turn.Direction = Forward
+				res.Next = &turn
+			} else {
+				turn.Direction = Backward
+				res.Prev = &turn
+			}
+		}
+		return res
+	}
+
+	first, last := messages[0], messages[len(messages)-1]
+
+	if backward {
+		res.Next = cursorOf(last, Forward)
+		if hasMore {
+			res.Prev = cursorOf(first, Backward)
+		}
+	} else {
+		if hasMore {
+			res.Next = cursorOf(last, Forward)
+		}
+		if page.Cursor != nil {
+			res.Prev = cursorOf(first, Backward)
+		}
+	}
+
+	return res
+}
+
+func reverse(messages []model.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
@@ -0,0 +1,112 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/CatalinPlesu/message-service/model"
+)
+
+func testMessage(id string, createdAt time.Time) model.Message {
+	return model.Message{
+		MessageID: uuid.MustParse(id),
+		CreatedAt: &createdAt,
+	}
+}
+
+func TestPageResult(t *testing.T) {
+	base := time.Date(2024, 11, 2, 9, 30, 0, 0, time.UTC)
+	first := testMessage("0f8b6f5e-7c1a-4b7e-8d2c-5a9e3b1c4d60", base)
+	last := testMessage("9c3e2a41-5b7d-4e8f-a1c2-3d4e5f607182", base.Add(time.Second))
+	messages := []model.Message{first, last}
+
+	position := Cursor{
+		CreatedAt: base.Add(-time.Minute),
+		MessageID: uuid.MustParse("4a1f6c1e-2d6b-4c38-9a57-0d1f0e2b7c11"),
+	}
+	forward, backward := position, position
+	backward.Direction = Backward
+
+	tests := []struct {
+		name     string
+		messages []model.Message
+		cursor   *Cursor
+		hasMore  bool
+		wantNext *Cursor
+		wantPrev *Cursor
+	}{
+		{
+			name:     "first page, end of listing",
+			messages: messages,
+		},
+		{
+			name:     "first page, more to come",
+			messages: messages,
+			hasMore:  true,
+			wantNext: cursorOf(last, Forward),
+		},
+		{
+			name:     "forward, more to come",
+			messages: messages,
+			cursor:   &forward,
+			hasMore:  true,
+			wantNext: cursorOf(last, Forward),
+			wantPrev: cursorOf(first, Backward),
+		},
+		{
+			name:     "forward, end of listing",
+			messages: messages,
+			cursor:   &forward,
+			wantPrev: cursorOf(first, Backward),
+		},
+		{
+			name:     "backward, more to come",
+			messages: messages,
+			cursor:   &backward,
+			hasMore:  true,
+			wantNext: cursorOf(last, Forward),
+			wantPrev: cursorOf(first, Backward),
+		},
+		{
+			name:     "backward, start of listing",
+			messages: messages,
+			cursor:   &backward,
+			wantNext: cursorOf(last, Forward),
+		},
+		{
+			name: "empty first page",
+		},
+		{
+			name:     "empty forward",
+			cursor:   &forward,
+			wantPrev: &backward,
+		},
+		{
+			name:     "empty backward",
+			cursor:   &backward,
+			wantNext: &forward,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := pageResult(tt.messages, FindAllPage{Size: 2, Cursor: tt.cursor}, tt.hasMore)
+
+			if res.Messages == nil {
+				t.Error("got nil messages")
+			}
+			assertCursor(t, "next", res.Next, tt.wantNext)
+			assertCursor(t, "prev", res.Prev, tt.wantPrev)
+		})
+	}
+}
+
+func assertCursor(t *testing.T, name string, got, want *Cursor) {
+	t.Helper()
+
+	if (got == nil) != (want == nil) || got != nil && *got != *want {
+		t.Errorf("got %s %+v, want %+v", name, got, want)
+	}
+}